@@ -4,26 +4,116 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
-	"os"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 // Configuration is the overall config object
 type Configuration struct {
-	Address         string      `json:"addr"`
-	Retain          int64       `json:"retain"`
-	Frequency       string      `json:"frequency"`
-	AWS             S3Config    `json:"aws_storage"`
-	Local           LocalConfig `json:"local_storage"`
-	GCP             GCPConfig   `json:"google_storage"`
-	Azure           AzureConfig `json:"azure_storage"`
-	RoleID          string      `json:"role_id"`
-	SecretID        string      `json:"secret_id"`
-	Approle         string      `json:"approle"`
-	K8sAuthRole     string      `json:"k8s_auth_role,omitempty"`
-	K8sAuthPath     string      `json:"k8s_auth_path,omitempty"`
-	VaultAuthMethod string      `json:"vault_auth_method,omitempty"`
+	Address         string           `json:"addr"`
+	CACert          string           `json:"ca_cert,omitempty"`
+	CAPath          string           `json:"ca_path,omitempty"`
+	ClientCert      string           `json:"client_cert,omitempty"`
+	ClientKey       string           `json:"client_key,omitempty"`
+	TLSServerName   string           `json:"tls_server_name,omitempty"`
+	TLSSkipVerify   bool             `json:"tls_skip_verify,omitempty"`
+	Retain          int64            `json:"retain"`
+	Retention       RetentionConfig  `json:"retention"`
+	Retry           RetryConfig      `json:"retry"`
+	Frequency       string           `json:"frequency"`
+	AlignFrequency  bool             `json:"align_frequency,omitempty"`
+	Schedule        string           `json:"schedule,omitempty"`
+	Jitter          string           `json:"jitter,omitempty"`
+	ShutdownTimeout string           `json:"shutdown_timeout,omitempty"`
+	ScratchPath     string           `json:"local_scratch_path,omitempty"`
+	MemoryLimitMB   int64            `json:"memory_limit_mb,omitempty"`
+	LogLevel        string           `json:"log_level,omitempty"`
+	LogFormat       string           `json:"log_format,omitempty"`
+	HTTP            HTTPConfig       `json:"http"`
+	Health          HealthConfig     `json:"health"`
+	Webhooks        []WebhookConfig  `json:"webhooks,omitempty"`
+	Encryption      EncryptionConfig `json:"encryption"`
+	AWS             S3Config         `json:"aws_storage"`
+	Local           LocalConfig      `json:"local_storage"`
+	GCP             GCPConfig        `json:"google_storage"`
+	Azure           AzureConfig      `json:"azure_storage"`
+	RoleID          string           `json:"role_id"`
+	SecretID        string           `json:"secret_id"`
+	Approle         string           `json:"approle"`
+	K8sAuthRole     string           `json:"k8s_auth_role,omitempty"`
+	K8sAuthPath     string           `json:"k8s_auth_path,omitempty"`
+	CertAuthRole    string           `json:"cert_auth_role,omitempty"`
+	CertAuthPath    string           `json:"cert_auth_path,omitempty"`
+	VaultAuthMethod string           `json:"vault_auth_method,omitempty"`
+}
+
+// RetentionConfig is the grandfather-father-son retention policy.  Each count
+// keeps the newest snapshot of that many of the most recent periods.  MaxAge
+// additionally limits the age of kept snapshots, but never below MinKeep.
+type RetentionConfig struct {
+	Hourly  int `json:"hourly"`
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+	Yearly  int `json:"yearly"`
+	// MaxAge deletes snapshots older than this duration, e.g. "720h"
+	MaxAge string `json:"max_age,omitempty"`
+	// MinKeep is the number of newest snapshots that are never deleted
+	MinKeep int `json:"min_keep,omitempty"`
+}
+
+// RetryConfig is the exponential backoff for retrying failed Vault requests and uploads
+type RetryConfig struct {
+	MaxAttempts     int     `json:"max_attempts"`
+	InitialInterval string  `json:"initial_interval"`
+	MaxInterval     string  `json:"max_interval"`
+	Multiplier      float64 `json:"multiplier"`
+}
+
+// HTTPConfig is the local HTTP API of the agent
+type HTTPConfig struct {
+	ListenAddress string `json:"listen_address"`
+	// Token authenticates requests that trigger snapshots
+	Token string `json:"token"`
+}
+
+// HealthConfig controls when the health endpoints report the agent as unhealthy
+type HealthConfig struct {
+	// StalenessThreshold is the maximum age of the last successful snapshot on the leader
+	StalenessThreshold string `json:"staleness_threshold"`
+	// StuckTimeout is how long a single snapshot may run before the agent is considered stuck
+	StuckTimeout string `json:"stuck_timeout"`
+}
+
+// WebhookConfig is an HTTP endpoint that is notified of snapshot events
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Format is the payload format: generic, slack or teams
+	Format string `json:"format,omitempty"`
+	// Template is a Go template for the payload, overriding Format
+	Template string `json:"template,omitempty"`
+	// Events limits the notifications to the given event types
+	Events  []string          `json:"events,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// EncryptionConfig selects the keys that snapshots are encrypted with before
+// they are written to any storage.  Every configured key can decrypt them.
+type EncryptionConfig struct {
+	// KeyFile holds a base64 encoded 256 bit key
+	KeyFile string `json:"key_file,omitempty"`
+	// DecryptionKeyFiles are previous keys, only used to decrypt older snapshots
+	DecryptionKeyFiles []string `json:"decryption_key_files,omitempty"`
+	// AgeRecipients are age X25519 public keys
+	AgeRecipients []string `json:"age_recipients,omitempty"`
+	// AgeIdentityFile holds the age private keys used to decrypt snapshots
+	AgeIdentityFile string `json:"age_identity_file,omitempty"`
+	// TransitKey is the name of a Vault Transit key
+	TransitKey   string `json:"transit_key,omitempty"`
+	TransitMount string `json:"transit_mount,omitempty"`
+	// TransitDataKey obtains the data key of every snapshot from Transit instead
+	// of generating it in the agent
+	TransitDataKey bool `json:"transit_datakey,omitempty"`
 }
 
 // AzureConfig is the configuration for Azure blob snapshots
@@ -55,13 +145,22 @@ type S3Config struct {
 	SSE                bool   `json:"s3_server_side_encryption"`
 	StaticSnapshotName string `json:"s3_static_snapshot_name"`
 	S3ForcePathStyle   bool   `json:"s3_force_path_style"`
+
+	// SSEKMSKeyID turns on SSE-KMS with the given key ID, ARN or alias
+	SSEKMSKeyID             string            `json:"s3_sse_kms_key_id"`
+	SSEKMSEncryptionContext map[string]string `json:"s3_sse_kms_encryption_context"`
+	SSEBucketKeyEnabled     bool              `json:"s3_sse_bucket_key_enabled"`
+	// SSECustomerKeyFile turns on SSE-C with the base64 encoded key in the file
+	SSECustomerKeyFile string `json:"s3_sse_customer_key_file"`
 }
 
+// DefaultConfigFile is read if no configuration file is given on the command line
+const DefaultConfigFile = "/etc/vault.d/snapshot.json"
+
 // ReadConfig reads the configuration file
-func ReadConfig() (*Configuration, error) {
-	file := "/etc/vault.d/snapshot.json"
-	if len(os.Args) > 1 {
-		file = os.Args[1]
+func ReadConfig(file string) (*Configuration, error) {
+	if file == "" {
+		file = DefaultConfigFile
 	}
 	cBytes, err := ioutil.ReadFile(file)
 	if err != nil {
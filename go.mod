@@ -4,12 +4,17 @@ go 1.13
 
 require (
 	cloud.google.com/go v0.38.0
+	filippo.io/age v1.0.0-rc.3
 	github.com/Azure/azure-storage-blob-go v0.8.0
 	github.com/Azure/go-autorest/autorest/adal v0.8.3 // indirect
-	github.com/aws/aws-sdk-go v1.30.14
+	github.com/aws/aws-sdk-go v1.38.0
 	github.com/googleapis/gax-go v2.0.2+incompatible // indirect
+	github.com/hashicorp/go-hclog v0.9.1
 	github.com/hashicorp/raft v1.1.2
 	github.com/hashicorp/vault/api v1.0.4
+	github.com/prometheus/client_golang v1.11.1
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/stretchr/testify v1.5.1 // indirect
 	go.opencensus.io v0.22.3 // indirect
 	google.golang.org/api v0.22.0
 )
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"github.com/Lucretius/vault_raft_snapshot_agent/snapshot_agent"
+)
+
+const (
+	// stalenessCheckInterval is how often the staleness threshold is checked
+	// for sending webhook events
+	stalenessCheckInterval = time.Minute
+	// scheduleGracePeriod is how late the scheduling loop may wake up before it
+	// is considered stuck
+	scheduleGracePeriod = time.Minute
+	// readinessCacheTTL limits how often probes hit Vault and the storages
+	readinessCacheTTL = 10 * time.Second
+	readinessTimeout  = 10 * time.Second
+)
+
+// health tracks the state of the agent reported by the health endpoints
+type health struct {
+	stalenessThreshold time.Duration
+	stuckTimeout       time.Duration
+
+	mu          sync.Mutex
+	snapshotter *snapshot_agent.Snapshotter
+	started     time.Time
+	// runningSince is set while a snapshot or login is in progress
+	runningSince time.Time
+	nextRun      time.Time
+	lastRun      time.Time
+	// leader is nil until the leader was looked up successfully
+	leader       *bool
+	destinations []*destinationStatus
+	// staleNotified is set once the staleness event was sent, until the
+	// snapshots are recent again
+	staleNotified bool
+
+	readyMu    sync.Mutex
+	readyAt    time.Time
+	readyCode  int
+	readyState readiness
+}
+
+// destinationStatus is the outcome of the last snapshot to a destination
+type destinationStatus struct {
+	Destination string     `json:"destination"`
+	Location    string     `json:"location,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Outcome     string     `json:"outcome,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func newHealth(c *config.Configuration) (*health, error) {
+	h := &health{started: time.Now(), stuckTimeout: time.Hour}
+	if c.Health.StalenessThreshold != "" {
+		threshold, err := time.ParseDuration(c.Health.StalenessThreshold)
+		if err != nil {
+			return nil, err
+		}
+		h.stalenessThreshold = threshold
+	}
+	if c.Health.StuckTimeout != "" {
+		timeout, err := time.ParseDuration(c.Health.StuckTimeout)
+		if err != nil {
+			return nil, err
+		}
+		h.stuckTimeout = timeout
+	}
+	return h, nil
+}
+
+// setSnapshotter makes the snapshotter available once the agent logged in
+func (h *health) setSnapshotter(snapshotter *snapshot_agent.Snapshotter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.snapshotter = snapshotter
+	for _, dest := range snapshotter.Destinations {
+		h.destinations = append(h.destinations, &destinationStatus{Destination: dest.Name})
+	}
+}
+
+func (h *health) getSnapshotter() *snapshot_agent.Snapshotter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.snapshotter
+}
+
+// running marks the start and end of an operation of the scheduling loop, which
+// must finish within the stuck timeout.  A slot that is due is cleared, so that
+// the loop is not considered late until it schedules the next one, while
+// triggered snapshots before the slot keep it.
+func (h *health) running(running bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if running {
+		h.runningSince = time.Now()
+		if !h.nextRun.After(h.runningSince) {
+			h.nextRun = time.Time{}
+		}
+	} else {
+		h.runningSince = time.Time{}
+	}
+}
+
+// scheduled records when the scheduling loop is due to wake up next
+func (h *health) scheduled(next time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextRun = next
+}
+
+// record updates the status with the outcome of takeSnapshot
+func (h *health) record(run *snapshot_agent.SnapshotRun, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.lastRun = now
+	// the leader lookup failed if there is neither a run nor errNotLeader
+	if run != nil || err == errNotLeader {
+		leader := run != nil
+		h.leader = &leader
+	}
+	if run == nil {
+		return
+	}
+	outcomes := make(map[string]snapshot_agent.SnapshotResult)
+	for _, result := range run.Results {
+		outcomes[result.Destination] = result
+	}
+	for _, status := range h.destinations {
+		status.LastAttempt = &now
+		result, ok := outcomes[status.Destination]
+		if ok && result.Location != "" {
+			status.LastSuccess = &now
+			status.Outcome = "success"
+			status.Name = result.Name
+			status.Location = result.Location
+			status.Size = run.Size
+			status.Error = ""
+			// pruning failures are reported without failing the snapshot
+			if result.Err != nil {
+				status.Error = result.Err.Error()
+			}
+			continue
+		}
+		status.Outcome = "failure"
+		switch {
+		case ok && result.Err != nil:
+			status.Error = result.Err.Error()
+		case err != nil:
+			status.Error = err.Error()
+		}
+	}
+}
+
+// stuck reports whether the scheduling loop failed to make progress
+func (h *health) stuck(now time.Time) bool {
+	if !h.runningSince.IsZero() {
+		return now.Sub(h.runningSince) > h.stuckTimeout
+	}
+	return !h.nextRun.IsZero() && now.After(h.nextRun.Add(scheduleGracePeriod))
+}
+
+// stale reports whether the leader has not written a snapshot to a destination
+// within the staleness threshold
+func (h *health) stale(now time.Time) bool {
+	return len(h.staleDestinations(now)) > 0
+}
+
+// staleDestinations returns the destinations that make the leader stale
+func (h *health) staleDestinations(now time.Time) []*destinationStatus {
+	if h.stalenessThreshold == 0 || h.leader == nil || !*h.leader {
+		return nil
+	}
+	var stale []*destinationStatus
+	for _, status := range h.destinations {
+		last := h.started
+		if status.LastSuccess != nil {
+			last = *status.LastSuccess
+		}
+		if now.Sub(last) > h.stalenessThreshold {
+			stale = append(stale, status)
+		}
+	}
+	return stale
+}
+
+// watchStaleness sends a snapshot_stale event whenever the leader becomes
+// stale.  It is sent once until snapshots are recent again.
+func (h *health) watchStaleness(ctx context.Context) {
+	if h.stalenessThreshold == 0 {
+		return
+	}
+	interval := stalenessCheckInterval
+	if h.stalenessThreshold < 2*interval {
+		interval = h.stalenessThreshold / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.mu.Lock()
+		now := time.Now()
+		var stale []snapshot_agent.EventDestination
+		for _, status := range h.staleDestinations(now) {
+			dest := snapshot_agent.EventDestination{Destination: status.Destination, Name: status.Name, Location: status.Location}
+			if status.LastSuccess != nil {
+				dest.Error = "no snapshot since " + status.LastSuccess.UTC().Format(time.RFC3339)
+			} else {
+				dest.Error = "no snapshot since " + h.started.UTC().Format(time.RFC3339)
+			}
+			stale = append(stale, dest)
+		}
+		notify := len(stale) > 0 && !h.staleNotified
+		h.staleNotified = len(stale) > 0
+		snapshotter := h.snapshotter
+		h.mu.Unlock()
+		if notify && snapshotter != nil {
+			snapshot_agent.Logger(ctx).Warn("Snapshots are stale", "threshold", h.stalenessThreshold.String(), "destinations", len(stale))
+			snapshotter.NotifyStale(ctx, stale)
+		}
+	}
+}
+
+// handleHealthz is the liveness probe, which fails if the scheduling loop is stuck
+func (h *health) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	stuck := h.stuck(time.Now())
+	h.mu.Unlock()
+	if stuck {
+		http.Error(w, "scheduling loop is stuck", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// readiness is the JSON body returned by /readyz
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleReadyz is the readiness probe, which checks that the agent is logged in
+// to Vault and can reach every destination.  Results are cached briefly so that
+// frequent probes do not hammer Vault and the storages.
+func (h *health) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	h.readyMu.Lock()
+	if time.Since(h.readyAt) > readinessCacheTTL {
+		h.readyState = h.checkReadiness(r.Context())
+		h.readyCode = http.StatusOK
+		if !h.readyState.Ready {
+			h.readyCode = http.StatusServiceUnavailable
+		}
+		h.readyAt = time.Now()
+	}
+	state, code := h.readyState, h.readyCode
+	h.readyMu.Unlock()
+	writeJSON(w, code, state)
+}
+
+func (h *health) checkReadiness(ctx context.Context) readiness {
+	state := readiness{Ready: true, Checks: make(map[string]string)}
+	snapshotter := h.getSnapshotter()
+	if snapshotter == nil {
+		state.Ready = false
+		state.Checks["vault"] = "not logged in to Vault"
+		return state
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	check := func(name string, fn func(context.Context) error) {
+		defer wg.Done()
+		result := "ok"
+		if err := fn(ctx); err != nil {
+			result = err.Error()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if result != "ok" {
+			state.Ready = false
+		}
+		state.Checks[name] = result
+	}
+	wg.Add(1 + len(snapshotter.Destinations))
+	go check("vault", snapshotter.CheckToken)
+	for _, dest := range snapshotter.Destinations {
+		go check(dest.Name, dest.Storage.Check)
+	}
+	wg.Wait()
+	return state
+}
+
+// status is the JSON body returned by /status
+type status struct {
+	Healthy            bool                 `json:"healthy"`
+	Stuck              bool                 `json:"stuck"`
+	Stale              bool                 `json:"stale"`
+	StalenessThreshold string               `json:"staleness_threshold,omitempty"`
+	Leader             *bool                `json:"leader"`
+	LastRun            *time.Time           `json:"last_run,omitempty"`
+	NextRun            *time.Time           `json:"next_run,omitempty"`
+	Destinations       []*destinationStatus `json:"destinations"`
+}
+
+// handleStatus reports the outcome of the last snapshot per destination
+func (h *health) handleStatus(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	now := time.Now()
+	s := status{
+		Stuck:        h.stuck(now),
+		Stale:        h.stale(now),
+		Leader:       h.leader,
+		Destinations: make([]*destinationStatus, 0, len(h.destinations)),
+	}
+	s.Healthy = !s.Stuck && !s.Stale
+	if h.stalenessThreshold != 0 {
+		s.StalenessThreshold = h.stalenessThreshold.String()
+	}
+	if !h.lastRun.IsZero() {
+		lastRun := h.lastRun
+		s.LastRun = &lastRun
+	}
+	if !h.nextRun.IsZero() {
+		nextRun := h.nextRun
+		s.NextRun = &nextRun
+	}
+	for _, dest := range h.destinations {
+		copied := *dest
+		s.Destinations = append(s.Destinations, &copied)
+	}
+	h.mu.Unlock()
+
+	code := http.StatusOK
+	if !s.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, s)
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
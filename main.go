@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
@@ -10,94 +11,319 @@ import (
 
 	"github.com/Lucretius/vault_raft_snapshot_agent/config"
 	"github.com/Lucretius/vault_raft_snapshot_agent/snapshot_agent"
+	vaultApi "github.com/hashicorp/vault/api"
 )
 
-func listenForInterruptSignals() chan bool {
-	sigs := make(chan os.Signal, 1)
+// Exit codes of the agent, in particular of a single snapshot run with "once"
+const (
+	exitOK              = 0
+	exitConfigError     = 1
+	exitUsage           = 2
+	exitNotLeader       = 3
+	exitAuthFailure     = 4
+	exitSnapshotFailure = 5
+	exitPartialFailure  = 6
+	exitPruneFailure    = 7
+)
+
+// revokeTimeout bounds revoking the Vault token on exit
+const revokeTimeout = 10 * time.Second
+
+// listenForInterruptSignals returns a channel that is closed on the first SIGINT
+// or SIGTERM, upon which no new snapshots are started, and a context that is
+// canceled to abort the running one once the drain timeout passes or a second
+// signal is received
+func listenForInterruptSignals(c *config.Configuration) (chan struct{}, context.Context) {
+	drainTimeout := 30 * time.Second
+	if c.ShutdownTimeout != "" {
+		timeout, err := time.ParseDuration(c.ShutdownTimeout)
+		if err != nil {
+			fatal("Invalid shutdown_timeout", "error", err)
+		}
+		drainTimeout = timeout
+	}
+
+	sigs := make(chan os.Signal, 2)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	done := make(chan bool, 1)
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
-		_ = <-sigs
-		done <- true
+		<-sigs
+		snapshot_agent.Logger(ctx).Info("Shutting down, waiting for running operations to finish", "timeout", drainTimeout.String())
+		close(done)
+		select {
+		case <-sigs:
+		case <-time.After(drainTimeout):
+		}
+		snapshot_agent.Logger(ctx).Warn("Aborting running operations")
+		cancel()
 	}()
-	return done
+	return done, ctx
 }
 
 func main() {
-	done := listenForInterruptSignals()
-
-	log.Println("Reading configuration...")
-	c, err := config.ReadConfig()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "prune":
+			runPrune(os.Args[2:])
+			return
+		case "once":
+			runOnce(os.Args[2:])
+			return
+		}
+	}
+	configFile := ""
+	if len(os.Args) > 1 {
+		configFile = os.Args[1]
+	}
+	runAgent(configFile)
+}
 
+// loadConfig reads the configuration file and sets up logging as configured
+func loadConfig(configFile string) *config.Configuration {
+	c, err := config.ReadConfig(configFile)
 	if err != nil {
 		log.Fatalln("Configuration could not be found")
 	}
+	if err := snapshot_agent.ConfigureLogging(c); err != nil {
+		log.Fatalln(err)
+	}
+	return c
+}
 
-	snapshotter, err := snapshot_agent.NewSnapshotter(c)
-	if err != nil {
-		log.Fatalln("Cannot instantiate snapshotter.", err)
+// fatal logs an error that prevents the agent from starting and exits
+func fatal(msg string, args ...interface{}) {
+	snapshot_agent.Logger(context.Background()).Error(msg, args...)
+	exit(exitConfigError)
+}
+
+// session is the login of the running command, whose Vault token is kept
+// valid in the background and revoked by exit
+var session struct {
+	snapshotter *snapshot_agent.Snapshotter
+	stopToken   context.CancelFunc
+}
+
+// startSession starts renewing the Vault token of snapshotter until exit
+func startSession(ctx context.Context, c *config.Configuration, snapshotter *snapshot_agent.Snapshotter) {
+	tokenCtx, stopToken := context.WithCancel(ctx)
+	go snapshotter.ManageToken(tokenCtx, c)
+	session.snapshotter = snapshotter
+	session.stopToken = stopToken
+}
+
+// exit revokes the Vault token of the session, if any, and exits with code
+func exit(code int) {
+	if session.snapshotter != nil {
+		session.stopToken()
+		revokeToken(session.snapshotter)
 	}
-	frequency, err := time.ParseDuration(c.Frequency)
+	os.Exit(code)
+}
+
+func runAgent(configFile string) {
+	c := loadConfig(configFile)
+	done, ctx := listenForInterruptSignals(c)
+	logger := snapshot_agent.Logger(ctx)
+	if configFile == "" {
+		configFile = config.DefaultConfigFile
+	}
+	logger.Info("Loaded configuration", "file", configFile)
 
+	schedule, err := snapshot_agent.NewSchedule(c)
+	if err != nil {
+		fatal("Invalid schedule", "error", err)
+	}
+	a, err := newAgent(c, done)
 	if err != nil {
-		frequency = time.Hour
+		fatal("Invalid health configuration", "error", err)
+	}
+	if err := a.serveHTTP(ctx); err != nil {
+		fatal("Cannot start HTTP API", "error", err)
 	}
+	a.listenForTriggerSignal(ctx)
 
-	for {
-		if snapshotter.TokenExpiration.Before(time.Now()) {
-			switch c.VaultAuthMethod {
-			case "k8s":
-				snapshotter.SetClientTokenFromK8sAuth(c)
-			default:
-				snapshotter.SetClientTokenFromAppRole(c)
-			}
+	a.health.running(true)
+	snapshotter, err := snapshot_agent.NewSnapshotter(ctx, c)
+	a.health.running(false)
+	// Vault being unavailable at startup is not fatal, the daemon keeps trying
+	// to log in at every scheduled snapshot until it succeeds
+	waited := false
+	for loginFailed(err) {
+		logger.Error("Cannot instantiate snapshotter, retrying at the next scheduled snapshot", "error", err)
+		if !a.waitUntil(schedule.Next(time.Now())) {
+			os.Exit(exitOK)
 		}
-		leader, err := snapshotter.API.Sys().Leader()
-		if err != nil {
-			log.Println(err.Error())
-			log.Fatalln("Unable to determine leader instance.  The snapshot agent will only run on the leader node.  Are you running this daemon on a Vault instance?")
+		waited = true
+		a.health.running(true)
+		snapshotter, err = snapshot_agent.NewSnapshotter(ctx, c)
+		a.health.running(false)
+	}
+	if err != nil {
+		fatal("Cannot instantiate snapshotter", "error", err)
+	}
+	a.health.setSnapshotter(snapshotter)
+	go a.health.watchStaleness(ctx)
+	startSession(ctx, c, snapshotter)
+	// plain frequencies keep taking the first snapshot right away, while aligned
+	// and cron schedules wait for their first slot
+	if (c.Schedule != "" || c.AlignFrequency) && !waited {
+		if !a.waitUntil(schedule.Next(time.Now())) {
+			exit(exitOK)
 		}
-		leaderIsSelf := leader.IsSelf
-		if !leaderIsSelf {
-			log.Println("Not running on leader node, skipping.")
-		} else {
-			var snapshot bytes.Buffer
-			err := snapshotter.API.Sys().RaftSnapshot(&snapshot)
-			if err != nil {
-				log.Fatalln("Unable to generate snapshot", err.Error())
-			}
-			now := time.Now().UnixNano()
-			if c.Local.Path != "" {
-				snapshotPath, err := snapshotter.CreateLocalSnapshot(&snapshot, c, now)
-				logSnapshotError("local", snapshotPath, err)
-			}
-			if c.AWS.Bucket != "" {
-				snapshotPath, err := snapshotter.CreateS3Snapshot(&snapshot, c, now)
-				logSnapshotError("aws", snapshotPath, err)
-			}
-			if c.GCP.Bucket != "" {
-				snapshotPath, err := snapshotter.CreateGCPSnapshot(&snapshot, c, now)
-				logSnapshotError("gcp", snapshotPath, err)
-			}
-			if c.Azure.ContainerName != "" {
-				snapshotPath, err := snapshotter.CreateAzureSnapshot(&snapshot, c, now)
-				logSnapshotError("azure", snapshotPath, err)
-			}
+	}
+
+	for {
+		// failures are logged and retried at the next scheduled snapshot
+		a.snapshot(ctx)
+		next := schedule.Next(time.Now())
+		if !shuttingDown(done) {
+			logger.Info("Next snapshot scheduled", "at", next.Format(time.RFC3339))
 		}
-		select {
-		case <-time.After(frequency):
-			continue
-		case <-done:
-			os.Exit(1)
+		if !a.waitUntil(next) {
+			// a triggered snapshot may still be running
+			a.wait()
+			logger.Info("Shutdown complete")
+			exit(exitOK)
 		}
 	}
 }
 
-func logSnapshotError(dest, snapshotPath string, err error) {
+// errNotLeader is returned by takeSnapshot if this node is not the leader
+var errNotLeader = errors.New("not running on leader node")
+
+// takeSnapshot snapshots to all destinations if this node is the leader and logs
+// the outcome.  An error is returned if no snapshot could be taken at all, while
+// failures of single destinations are only reported in the run.  The run is only
+// returned if this node is the leader.
+func takeSnapshot(ctx context.Context, snapshotter *snapshot_agent.Snapshotter, c *config.Configuration) (*snapshot_agent.SnapshotRun, error) {
+	logger := snapshot_agent.Logger(ctx)
+	start := time.Now()
+	var leader *vaultApi.LeaderResponse
+	err := snapshotter.Retry.Do(ctx, "determine leader", func() error {
+		var err error
+		leader, err = snapshotter.Leader(ctx)
+		return err
+	})
+	if err != nil {
+		logger.Error("Unable to determine leader instance.  The snapshot agent will only run on the leader node.  Are you running this daemon on a Vault instance?", "error", err)
+		snapshotter.NotifyRun(ctx, nil, err)
+		return nil, err
+	}
+	if !leader.IsSelf {
+		logger.Info("Not running on leader node, skipping")
+		return nil, errNotLeader
+	}
+	// the token manager keeps logging in again in the background, so snapshots
+	// fail right away until it succeeds
+	if err := snapshotter.TokenErr(); err != nil {
+		logger.Error("Unable to generate snapshot", "error", err)
+		snapshotter.NotifyRun(ctx, nil, err)
+		return nil, err
+	}
+	run, err := snapshotter.TakeSnapshot(ctx, c)
 	if err != nil {
-		log.Printf("Failed to generate %s snapshot to %s: %v\n", dest, snapshotPath, err)
+		logger.Error("Unable to generate snapshot", "error", err, "duration_seconds", time.Since(start).Seconds())
+		snapshotter.NotifyRun(ctx, run, err)
+		return run, err
+	}
+	logSnapshotRun(ctx, run, time.Since(start))
+	snapshotter.NotifyRun(ctx, run, nil)
+	return run, nil
+}
+
+// revokeToken revokes the Vault token before the agent exits, even if the
+// running operations were aborted
+func revokeToken(snapshotter *snapshot_agent.Snapshotter) {
+	ctx, cancel := context.WithTimeout(context.Background(), revokeTimeout)
+	defer cancel()
+	if err := snapshotter.RevokeToken(ctx); err != nil {
+		snapshot_agent.Logger(ctx).Warn("Unable to revoke Vault token", "error", err)
+	}
+}
+
+// loginFailed reports whether err is a failure to log in to Vault, which the
+// daemon retries because Vault may be unavailable or sealed while it starts
+func loginFailed(err error) bool {
+	var authErr *snapshot_agent.AuthError
+	var unavailableErr *snapshot_agent.VaultUnavailableError
+	return errors.As(err, &authErr) || errors.As(err, &unavailableErr)
+}
+
+// exitCode maps the outcome of takeSnapshot to the exit code of the agent
+func exitCode(run *snapshot_agent.SnapshotRun, err error) int {
+	var authErr *snapshot_agent.AuthError
+	switch {
+	case err == errNotLeader:
+		return exitNotLeader
+	case errors.As(err, &authErr):
+		return exitAuthFailure
+	case err != nil:
+		return exitSnapshotFailure
+	}
+	failed := 0
+	for _, result := range run.Results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return exitOK
+	case failed == len(run.Results):
+		return exitSnapshotFailure
+	default:
+		return exitPartialFailure
+	}
+}
+
+// shuttingDown reports whether a shutdown was requested
+func shuttingDown(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitUntil blocks until t and returns false if the agent was interrupted before
+func waitUntil(t time.Time, done chan struct{}) bool {
+	select {
+	case <-time.After(time.Until(t)):
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// logSnapshotRun logs the failed destinations and a summary of the run
+func logSnapshotRun(ctx context.Context, run *snapshot_agent.SnapshotRun, duration time.Duration) {
+	logger := snapshot_agent.Logger(ctx)
+	failed := 0
+	for _, result := range run.Results {
+		if result.Err == nil {
+			continue
+		}
+		failed++
+		if result.Location != "" {
+			logger.Error("Failed to apply retention policy", "destination", result.Destination, "location", result.Location, "error", result.Err)
+		} else {
+			logger.Error("Failed to generate snapshot", "destination", result.Destination, "error", result.Err)
+		}
+	}
+	args := []interface{}{"bytes", run.Size, "duration_seconds", duration.Seconds(),
+		"destinations", len(run.Results), "failed", failed}
+	if run.Meta != nil {
+		args = append(args, "index", run.Meta.Index, "term", run.Meta.Term)
+	}
+	if failed > 0 {
+		logger.Warn("Snapshot run finished with failures", args...)
 	} else {
-		log.Printf("Successfully created %s snapshot to %s\n", dest, snapshotPath)
+		logger.Info("Snapshot run finished", args...)
 	}
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"github.com/Lucretius/vault_raft_snapshot_agent/snapshot_agent"
+)
+
+const onceUsage = `Usage: vault_raft_snapshot_agent once [options]
+
+Takes a single snapshot to all configured storages, applies the retention
+policy and exits, for scheduling the agent with Kubernetes CronJobs or systemd
+timers.  The exit code reports the outcome:
+
+  0  the snapshot was written to all storages
+  1  the configuration is invalid
+  3  this node is not the leader, no snapshot was taken
+  4  Vault rejected the credentials of the agent
+  5  Vault is unreachable, no snapshot could be taken, or it failed on all
+     storages
+  6  the snapshot failed on some of the storages
+
+Options:
+`
+
+func runOnce(args []string) {
+	flags := flag.NewFlagSet("once", flag.ExitOnError)
+	configFile := flags.String("config", config.DefaultConfigFile, "path to the configuration file")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), onceUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+
+	c := loadConfig(*configFile)
+	_, ctx := listenForInterruptSignals(c)
+	ctx, _ = snapshot_agent.WithRunID(ctx)
+	snapshotter, err := snapshot_agent.NewSnapshotter(ctx, c)
+	if err != nil {
+		snapshot_agent.Logger(ctx).Error("Cannot instantiate snapshotter", "error", err)
+		var authErr *snapshot_agent.AuthError
+		var unavailableErr *snapshot_agent.VaultUnavailableError
+		switch {
+		case errors.As(err, &authErr):
+			os.Exit(exitAuthFailure)
+		case errors.As(err, &unavailableErr):
+			os.Exit(exitSnapshotFailure)
+		}
+		os.Exit(exitConfigError)
+	}
+	startSession(ctx, c, snapshotter)
+	exit(exitCode(takeSnapshot(ctx, snapshotter, c)))
+}
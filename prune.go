@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"github.com/Lucretius/vault_raft_snapshot_agent/snapshot_agent"
+)
+
+const pruneUsage = `Usage: vault_raft_snapshot_agent prune [options]
+
+Applies the configured retention policy to every configured storage without
+taking a new snapshot, and prints which snapshots are kept and deleted.  Exits
+with status 7 if deleting snapshots failed on any storage.
+
+Options:
+`
+
+func runPrune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	configFile := flags.String("config", config.DefaultConfigFile, "path to the configuration file")
+	dryRun := flags.Bool("dry-run", false, "only print what would be deleted")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), pruneUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+
+	c := loadConfig(*configFile)
+	_, ctx := listenForInterruptSignals(c)
+	logger := snapshot_agent.Logger(ctx)
+	snapshotter, err := snapshot_agent.NewSnapshotter(ctx, c)
+	if err != nil {
+		fatal("Cannot instantiate snapshotter", "error", err)
+	}
+	startSession(ctx, c, snapshotter)
+	if !snapshotter.Retention.Enabled() {
+		logger.Info("No retention policy is configured, nothing to prune")
+		exit(exitOK)
+	}
+
+	deleted := "deleted"
+	if *dryRun {
+		deleted = "would be deleted"
+	}
+	failed := false
+	results := snapshotter.Prune(ctx, *dryRun)
+	for _, result := range results {
+		fmt.Printf("%s:\n", result.Destination)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, snapshot := range result.Kept {
+			fmt.Fprintf(w, "  %s\t%s\tkept\n", snapshot.Name, snapshot.Time().Format(time.RFC3339))
+		}
+		for _, snapshot := range result.Deleted {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", snapshot.Name, snapshot.Time().Format(time.RFC3339), deleted)
+		}
+		for _, snapshot := range result.Undeleted {
+			fmt.Fprintf(w, "  %s\t%s\tnot deleted\n", snapshot.Name, snapshot.Time().Format(time.RFC3339))
+		}
+		w.Flush()
+		if result.Err != nil {
+			logger.Error("Failed to prune snapshots", "destination", result.Destination, "error", result.Err)
+			failed = true
+		}
+	}
+	if !*dryRun {
+		snapshotter.NotifyPrune(ctx, results)
+	}
+	if failed {
+		exit(exitPruneFailure)
+	}
+	exit(exitOK)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"github.com/Lucretius/vault_raft_snapshot_agent/snapshot_agent"
+)
+
+const restoreUsage = `Usage: vault_raft_snapshot_agent restore [options] <snapshot>
+
+Downloads a snapshot from one of the configured storages and restores it into
+the Vault cluster.  <snapshot> is either the name of a snapshot, the timestamp
+in its name, a point in time in RFC3339 format, selecting the newest snapshot
+taken at or before it, or "latest".
+
+Options:
+`
+
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFile := flags.String("config", config.DefaultConfigFile, "path to the configuration file")
+	storage := flags.String("storage", "", "storage to restore from (local, aws, gcp or azure); required if more than one is configured")
+	force := flags.Bool("force", false, "restore a snapshot taken from a different cluster, overwriting the keyring")
+	list := flags.Bool("list", false, "list the available snapshots instead of restoring one")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), restoreUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	c := loadConfig(*configFile)
+	_, ctx := listenForInterruptSignals(c)
+	logger := snapshot_agent.Logger(ctx)
+	snapshotter, err := snapshot_agent.NewSnapshotter(ctx, c)
+	if err != nil {
+		fatal("Cannot instantiate snapshotter", "error", err)
+	}
+	// downloading a large snapshot may take longer than the token TTL
+	startSession(ctx, c, snapshotter)
+
+	if *list {
+		listSnapshots(ctx, snapshotter.Destinations)
+		exit(exitOK)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		exit(exitUsage)
+	}
+
+	dest, err := selectDestination(snapshotter.Destinations, *storage)
+	if err != nil {
+		fatal("Cannot select storage", "error", err)
+	}
+	snapshot, err := snapshot_agent.FindSnapshot(ctx, dest.Storage, flags.Arg(0))
+	if err != nil {
+		fatal("Unable to find snapshot", "destination", dest.Name, "error", err)
+	}
+	logger.Info("Restoring snapshot", "destination", dest.Name, "name", snapshot.Name)
+	if err := snapshotter.RestoreSnapshot(ctx, dest, snapshot.Name, *force); err != nil {
+		fatal("Failed to restore snapshot", "destination", dest.Name, "name", snapshot.Name, "error", err)
+	}
+	logger.Info("Successfully restored snapshot", "destination", dest.Name, "name", snapshot.Name)
+	exit(exitOK)
+}
+
+func selectDestination(destinations []snapshot_agent.Destination, name string) (snapshot_agent.Destination, error) {
+	if name == "" {
+		if len(destinations) != 1 {
+			return snapshot_agent.Destination{}, fmt.Errorf("%d storages are configured, select one with -storage", len(destinations))
+		}
+		return destinations[0], nil
+	}
+	for _, dest := range destinations {
+		if dest.Name == name {
+			return dest, nil
+		}
+	}
+	return snapshot_agent.Destination{}, fmt.Errorf("storage %s is not configured", name)
+}
+
+func listSnapshots(ctx context.Context, destinations []snapshot_agent.Destination) {
+	for _, dest := range destinations {
+		snapshots, err := snapshot_agent.SortedSnapshots(ctx, dest.Storage)
+		if err != nil {
+			snapshot_agent.Logger(ctx).Error("Unable to list snapshots", "destination", dest.Name, "location", dest.Storage.Describe(), "error", err)
+			continue
+		}
+		fmt.Printf("%s (%s):\n", dest.Name, dest.Storage.Describe())
+		for _, snapshot := range snapshots {
+			fmt.Printf("  %s\t%s\n", snapshot.Name, snapshot.Time().Format(time.RFC3339))
+		}
+	}
+}
@@ -4,80 +4,168 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"time"
+	"sync"
 
-	"cloud.google.com/go/storage"
-	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/Lucretius/vault_raft_snapshot_agent/config"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	vaultApi "github.com/hashicorp/vault/api"
 )
 
 type Snapshotter struct {
-	API             *vaultApi.Client
-	Uploader        *s3manager.Uploader
-	S3Client        *s3.S3
-	GCPBucket       *storage.BucketHandle
-	AzureUploader   azblob.ContainerURL
-	TokenExpiration time.Time
+	API *vaultApi.Client
+	// streamClient shares the transport of API but has no overall timeout, so
+	// that streaming large snapshots is only bounded by the request context
+	streamClient *http.Client
+	Destinations []Destination
+	Retention    RetentionPolicy
+	Retry        *RetryPolicy
+	Notifier     *Notifier
+	Encryptor    *Encryptor
+
+	// tokenMu guards the login result and error of the token manager
+	tokenMu     sync.Mutex
+	tokenSecret *vaultApi.Secret
+	tokenErr    error
 }
 
-func NewSnapshotter(config *config.Configuration) (*Snapshotter, error) {
+func NewSnapshotter(ctx context.Context, config *config.Configuration) (*Snapshotter, error) {
 	snapshotter := &Snapshotter{}
-	err := snapshotter.ConfigureVaultClient(config)
+	var err error
+	snapshotter.Retention, err = NewRetentionPolicy(config)
 	if err != nil {
 		return nil, err
 	}
-	if config.AWS.Bucket != "" {
-		err = snapshotter.ConfigureS3(config)
-		if err != nil {
-			return nil, err
-		}
+	snapshotter.Retry, err = NewRetryPolicy(config)
+	if err != nil {
+		return nil, err
 	}
-	if config.GCP.Bucket != "" {
-		err = snapshotter.ConfigureGCP(config)
-		if err != nil {
-			return nil, err
-		}
+	snapshotter.Notifier, err = NewNotifier(config, snapshotter.Retry)
+	if err != nil {
+		return nil, err
 	}
-	if config.Azure.ContainerName != "" {
-		err = snapshotter.ConfigureAzure(config)
-		if err != nil {
-			return nil, err
-		}
+	snapshotter.Encryptor, err = NewEncryptor(config, snapshotter)
+	if err != nil {
+		return nil, err
+	}
+	snapshotter.Destinations, err = ConfigureDestinations(config)
+	if err != nil {
+		return nil, err
+	}
+	err = limitDestinationBuffers(snapshotter.Destinations, config.MemoryLimitMB)
+	if err != nil {
+		return nil, err
+	}
+	initDestinationMetrics(snapshotter.Destinations)
+	err = snapshotter.ConfigureVaultClient(ctx, config)
+	if err != nil {
+		return nil, err
 	}
 	return snapshotter, nil
 }
 
-func (s *Snapshotter) ConfigureVaultClient(config *config.Configuration) error {
+func (s *Snapshotter) ConfigureVaultClient(ctx context.Context, config *config.Configuration) error {
 	vaultConfig := vaultApi.DefaultConfig()
 	if config.Address != "" {
 		vaultConfig.Address = config.Address
 	}
-	tlsConfig := &vaultApi.TLSConfig{
-		Insecure: true,
+	if vaultConfig.Error != nil {
+		return vaultConfig.Error
+	}
+	tlsConfig, err := vaultTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	if tlsConfig.Insecure {
+		Logger(ctx).Warn("TLS certificate verification of Vault is disabled")
+	}
+	if hasTLSFiles(tlsConfig) {
+		reloader, err := newTLSReloader(tlsConfig)
+		if err != nil {
+			return err
+		}
+		vaultConfig.HttpClient.Transport = reloader
+	} else if err := vaultConfig.ConfigureTLS(tlsConfig); err != nil {
+		return err
 	}
-	vaultConfig.ConfigureTLS(tlsConfig)
 	api, err := vaultApi.NewClient(vaultConfig)
 	if err != nil {
 		return err
 	}
 	s.API = api
-	if config.VaultAuthMethod == "k8s" {
-		return s.SetClientTokenFromK8sAuth(config)
+	s.streamClient = &http.Client{
+		Transport:     vaultConfig.HttpClient.Transport,
+		CheckRedirect: vaultConfig.HttpClient.CheckRedirect,
+	}
+	return s.Retry.Do(ctx, "log in to Vault", func() error {
+		return s.Login(ctx, config)
+	})
+}
+
+// AuthError is returned if Vault rejects the credentials of the agent
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return "unable to authenticate to Vault: " + e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// VaultUnavailableError is returned if the agent cannot log in because Vault
+// cannot be reached or fails to handle the request
+type VaultUnavailableError struct {
+	Err error
+}
+
+func (e *VaultUnavailableError) Error() string {
+	return "unable to reach Vault: " + e.Err.Error()
+}
+
+func (e *VaultUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// loginError classifies a failed login by whether Vault rejected it
+func loginError(err error) error {
+	var respErr *vaultApi.ResponseError
+	if errors.As(err, &respErr) {
+		if respErr.StatusCode == http.StatusBadRequest || respErr.StatusCode == http.StatusForbidden {
+			return &AuthError{Err: err}
+		}
+		return &VaultUnavailableError{Err: err}
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return &VaultUnavailableError{Err: err}
+	}
+	return err
+}
+
+// Login obtains a new client token using the configured auth method
+func (s *Snapshotter) Login(ctx context.Context, config *config.Configuration) error {
+	var err error
+	switch config.VaultAuthMethod {
+	case "k8s":
+		err = s.SetClientTokenFromK8sAuth(ctx, config)
+	case "cert":
+		err = s.SetClientTokenFromCertAuth(ctx, config)
+	default:
+		err = s.SetClientTokenFromAppRole(ctx, config)
+	}
+	if err != nil {
+		return loginError(err)
 	}
-	return s.SetClientTokenFromAppRole(config)
+	vaultLogins.Inc()
+	return nil
 }
 
-func (s *Snapshotter) SetClientTokenFromAppRole(config *config.Configuration) error {
+func (s *Snapshotter) SetClientTokenFromAppRole(ctx context.Context, config *config.Configuration) error {
 	data := map[string]interface{}{
 		"role_id":   config.RoleID,
 		"secret_id": config.SecretID,
@@ -86,16 +174,29 @@ func (s *Snapshotter) SetClientTokenFromAppRole(config *config.Configuration) er
 	if config.Approle != "" {
 		approle = config.Approle
 	}
-	resp, err := s.API.Logical().Write("auth/"+approle+"/login", data)
+	req := s.API.NewRequest("PUT", "/v1/auth/"+approle+"/login")
+	if err := req.SetJSONBody(data); err != nil {
+		return err
+	}
+	resp, err := s.API.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
 	if err != nil {
-		return fmt.Errorf("error logging into AppRole auth backend: %s", err)
+		return fmt.Errorf("error logging into AppRole auth backend: %w", err)
+	}
+	result, err := vaultApi.ParseSecret(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error logging into AppRole auth backend: %w", err)
+	}
+	if result == nil || result.Auth == nil {
+		return errors.New("error logging into AppRole auth backend: no token returned")
 	}
-	s.API.SetToken(resp.Auth.ClientToken)
-	s.TokenExpiration = time.Now().Add(time.Duration((time.Second * time.Duration(resp.Auth.LeaseDuration)) / 2))
+	s.setToken(result)
 	return nil
 }
 
-func (s *Snapshotter) SetClientTokenFromK8sAuth(config *config.Configuration) error {
+func (s *Snapshotter) SetClientTokenFromK8sAuth(ctx context.Context, config *config.Configuration) error {
 
 	if config.K8sAuthPath == "" || config.K8sAuthRole == "" {
 		return errors.New("missing k8s auth definitions")
@@ -114,7 +215,10 @@ func (s *Snapshotter) SetClientTokenFromK8sAuth(config *config.Configuration) er
 	req := s.API.NewRequest("POST", login)
 	req.SetJSONBody(data)
 
-	resp, err := s.API.RawRequest(req)
+	resp, err := s.API.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
 	if err != nil {
 		return err
 	}
@@ -127,62 +231,50 @@ func (s *Snapshotter) SetClientTokenFromK8sAuth(config *config.Configuration) er
 		return err
 	}
 
-	s.API.SetToken(result.Auth.ClientToken)
-	s.TokenExpiration = time.Now().Add(time.Duration((time.Second * time.Duration(result.Auth.LeaseDuration)) / 2))
-	return nil
-}
-
-func (s *Snapshotter) ConfigureS3(config *config.Configuration) error {
-	awsConfig := &aws.Config{Region: aws.String(config.AWS.Region)}
-
-	if config.AWS.AccessKeyID != "" && config.AWS.SecretAccessKey != "" {
-		awsConfig.Credentials = credentials.NewStaticCredentials(config.AWS.AccessKeyID, config.AWS.SecretAccessKey, "")
-	}
-
-	if config.AWS.Endpoint != "" {
-		awsConfig.Endpoint = aws.String(config.AWS.Endpoint)
+	if result.Auth == nil {
+		return errors.New("error logging into k8s auth backend: no token returned")
 	}
-
-	if config.AWS.S3ForcePathStyle != false {
-		awsConfig.S3ForcePathStyle = aws.Bool(config.AWS.S3ForcePathStyle)
-	}
-
-	sess := session.Must(session.NewSession(awsConfig))
-	s.S3Client = s3.New(sess)
-	s.Uploader = s3manager.NewUploader(sess)
+	s.setToken(&result)
 	return nil
 }
 
-func (s *Snapshotter) ConfigureGCP(config *config.Configuration) error {
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+// SetClientTokenFromCertAuth logs in with the client certificate that is
+// presented to Vault on the TLS connection
+func (s *Snapshotter) SetClientTokenFromCertAuth(ctx context.Context, config *config.Configuration) error {
+	tlsConfig, err := vaultTLSConfig(config)
 	if err != nil {
 		return err
 	}
-	s.GCPBucket = client.Bucket(config.GCP.Bucket)
-	return nil
-}
+	if tlsConfig.ClientCert == "" {
+		return errors.New("cert auth requires client_cert and client_key")
+	}
+	certAuthPath := "cert"
+	if config.CertAuthPath != "" {
+		certAuthPath = config.CertAuthPath
+	}
+	data := map[string]interface{}{}
+	if config.CertAuthRole != "" {
+		data["name"] = config.CertAuthRole
+	}
 
-func (s *Snapshotter) ConfigureAzure(config *config.Configuration) error {
-	accountName := config.Azure.AccountName
-	if os.Getenv("AZURE_STORAGE_ACCOUNT") != "" {
-		accountName = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	req := s.API.NewRequest("PUT", path.Clean("/v1/auth/"+certAuthPath+"/login"))
+	if err := req.SetJSONBody(data); err != nil {
+		return err
 	}
-	accountKey := config.Azure.AccountKey
-	if os.Getenv("AZURE_STORAGE_ACCESS_KEY") != "" {
-		accountKey = os.Getenv("AZURE_STORAGE_ACCESS_KEY")
+	resp, err := s.API.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
 	}
-	if len(accountName) == 0 || len(accountKey) == 0 {
-		return errors.New("Invalid Azure configuration")
+	if err != nil {
+		return fmt.Errorf("error logging into cert auth backend: %w", err)
 	}
-	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	result, err := vaultApi.ParseSecret(resp.Body)
 	if err != nil {
-		log.Fatal("Invalid credentials with error: " + err.Error())
+		return fmt.Errorf("error logging into cert auth backend: %w", err)
 	}
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	URL, _ := url.Parse(
-		fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, config.Azure.ContainerName))
-
-	s.AzureUploader = azblob.NewContainerURL(*URL, p)
+	if result == nil || result.Auth == nil {
+		return errors.New("error logging into cert auth backend: no token returned")
+	}
+	s.setToken(result)
 	return nil
 }
@@ -2,84 +2,139 @@ package snapshot_agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"sort"
+	"net/url"
+	"os"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/Lucretius/vault_raft_snapshot_agent/config"
 )
 
-// CreateAzureSnapshot writes snapshot to azure blob storage
-func (s *Snapshotter) CreateAzureSnapshot(reader io.ReadWriter, config *config.Configuration, currentTs int64) (string, error) {
-	ctx := context.Background()
-	url := fmt.Sprintf("raft_snapshot-%d.snap", currentTs)
-	blob := s.AzureUploader.NewBlockBlobURL(url)
+func init() {
+	RegisterStorage("azure", newAzureStorage)
+}
+
+// azureStorage writes snapshots to an azure blob container
+type azureStorage struct {
+	container  azblob.ContainerURL
+	bufferSize int
+	maxBuffers int
+}
+
+func newAzureStorage(config *config.Configuration) (Storage, error) {
+	if config.Azure.ContainerName == "" {
+		return nil, nil
+	}
+	accountName := config.Azure.AccountName
+	if os.Getenv("AZURE_STORAGE_ACCOUNT") != "" {
+		accountName = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	accountKey := config.Azure.AccountKey
+	if os.Getenv("AZURE_STORAGE_ACCESS_KEY") != "" {
+		accountKey = os.Getenv("AZURE_STORAGE_ACCESS_KEY")
+	}
+	if len(accountName) == 0 || len(accountKey) == 0 {
+		return nil, errors.New("Invalid Azure configuration")
+	}
+	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure credentials: %v", err)
+	}
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	URL, _ := url.Parse(
+		fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, config.Azure.ContainerName))
+
+	return &azureStorage{
+		container:  azblob.NewContainerURL(*URL, p),
+		bufferSize: 4 * 1024 * 1024,
+		maxBuffers: 16,
+	}, nil
+}
+
+// Upload writes snapshot to azure blob storage
+func (a *azureStorage) Upload(ctx context.Context, reader io.Reader, fileName string) (string, error) {
+	blob := a.container.NewBlockBlobURL(fileName)
 	_, err := azblob.UploadStreamToBlockBlob(ctx, reader, blob, azblob.UploadStreamToBlockBlobOptions{
-		BufferSize: 4 * 1024 * 1024,
-		MaxBuffers: 16,
+		BufferSize: a.bufferSize,
+		MaxBuffers: a.maxBuffers,
 	})
 	if err != nil {
+		a.discardBlocks(ctx, blob)
 		return "", err
-	} else {
-		if config.Retain > 0 {
-			deleteCtx := context.Background()
-			res, err := s.AzureUploader.ListBlobsFlatSegment(deleteCtx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{
-				Prefix:     "raft_snapshot-",
-				MaxResults: 500,
-			})
-			if err != nil {
-				log.Println("Unable to iterate through bucket to find old snapshots to delete")
-				return url, err
-			}
-			blobs := res.Segment.BlobItems
-			timestamp := func(o1, o2 *azblob.BlobItem) bool {
-				return o1.Properties.LastModified.Before(o2.Properties.LastModified)
-			}
-			AzureBy(timestamp).Sort(blobs)
-			if len(blobs)-int(config.Retain) <= 0 {
-				return url, nil
-			}
-			blobsToDelete := blobs[0 : len(blobs)-int(config.Retain)]
+	}
+	return fileName, nil
+}
+
+// discardBlocks removes the blocks staged by a failed upload.  Uncommitted
+// blocks cannot be deleted directly, so an empty block list is committed in
+// their place and the resulting empty blob deleted.
+func (a *azureStorage) discardBlocks(uploadCtx context.Context, blob azblob.BlockBlobURL) {
+	// the upload context may already be canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := blob.CommitBlockList(ctx, []string{}, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{})
+	if err == nil {
+		_, err = blob.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	}
+	if err != nil {
+		Logger(uploadCtx).Error("Unable to discard blocks of failed upload", "blob", blob.String(), "error", err)
+	}
+}
 
-			for _, b := range blobsToDelete {
-				val := s.AzureUploader.NewBlockBlobURL(b.Name)
-				val.Delete(deleteCtx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
-				if err != nil {
-					log.Println("Cannot delete old snapshot")
-					return url, err
-				}
+func (a *azureStorage) List(ctx context.Context) ([]SnapshotInfo, error) {
+	snapshots := make([]SnapshotInfo, 0)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		res, err := a.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix: "raft_snapshot-",
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range res.Segment.BlobItems {
+			if isSnapshotName(b.Name) {
+				snapshots = append(snapshots, SnapshotInfo{Name: b.Name, LastModified: b.Properties.LastModified})
 			}
 		}
-		return url, nil
+		marker = res.NextMarker
 	}
+	return snapshots, nil
 }
 
-// implementation of Sort interface for s3 objects
-type AzureBy func(f1, f2 *azblob.BlobItem) bool
-
-func (by AzureBy) Sort(objects []azblob.BlobItem) {
-	fs := &azObjectSorter{
-		objects: objects,
-		by:      by, // The Sort method's receiver is the function (closure) that defines the sort order.
-	}
-	sort.Sort(fs)
+func (a *azureStorage) Delete(ctx context.Context, name string) error {
+	blob := a.container.NewBlockBlobURL(name)
+	_, err := blob.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	return err
 }
 
-type azObjectSorter struct {
-	objects []azblob.BlobItem
-	by      func(f1, f2 *azblob.BlobItem) bool // Closure used in the Less method.
+func (a *azureStorage) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	blob := a.container.NewBlockBlobURL(name)
+	res, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
 }
 
-func (s *azObjectSorter) Len() int {
-	return len(s.objects)
+func (a *azureStorage) Check(ctx context.Context) error {
+	_, err := a.container.GetProperties(ctx, azblob.LeaseAccessConditions{})
+	return err
 }
 
-func (s *azObjectSorter) Less(i, j int) bool {
-	return s.by(&s.objects[i], &s.objects[j])
+// SetBufferLimit reduces the number of block buffers so that they fit into limit
+func (a *azureStorage) SetBufferLimit(limit int64) error {
+	maxBuffers := int(limit / int64(a.bufferSize))
+	if maxBuffers < 1 {
+		return fmt.Errorf("need at least %d bytes", a.bufferSize)
+	}
+	if maxBuffers < a.maxBuffers {
+		a.maxBuffers = maxBuffers
+	}
+	return nil
 }
 
-func (s *azObjectSorter) Swap(i, j int) {
-	s.objects[i], s.objects[j] = s.objects[j], s.objects[i]
+func (a *azureStorage) Describe() string {
+	return a.container.String()
 }
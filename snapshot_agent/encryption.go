@@ -0,0 +1,420 @@
+package snapshot_agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+)
+
+// An encrypted snapshot starts with encryptionMagic and the length of the JSON
+// encoded encryptionHeader, followed by the snapshot encrypted in chunks.  Each
+// chunk is sealed with AES-256-GCM under a random data key, which is stored in
+// the header wrapped by every configured key.
+//
+// The chunk nonces consist of a random prefix, the chunk counter and a flag
+// marking the last chunk, so that reordered, truncated or appended chunks fail
+// to decrypt.  The header is authenticated as additional data of every chunk.
+var encryptionMagic = []byte("VRSENC\x00\x01")
+
+const (
+	encryptionCipher    = "AES-256-GCM"
+	encryptionChunkSize = 64 * 1024
+	encryptionTagSize   = 16
+	noncePrefixSize     = 7
+	dataKeySize         = 32
+	maxHeaderSize       = 1024 * 1024
+)
+
+// encryptionHeader describes how a snapshot was encrypted
+type encryptionHeader struct {
+	Version     int        `json:"version"`
+	Cipher      string     `json:"cipher"`
+	ChunkSize   int        `json:"chunk_size"`
+	NoncePrefix []byte     `json:"nonce_prefix"`
+	Keys        []*keyWrap `json:"keys"`
+}
+
+// keyWrap is the data key wrapped by one of the configured keys
+type keyWrap struct {
+	Type string `json:"type"`
+	// KeyID identifies the key among several of the same type
+	KeyID string `json:"key_id,omitempty"`
+	Mount string `json:"mount,omitempty"`
+	Data  []byte `json:"data"`
+}
+
+// keyWrapper protects data keys with a key encryption key
+type keyWrapper interface {
+	// wrap encrypts the data key
+	wrap(ctx context.Context, dataKey []byte) (*keyWrap, error)
+	// unwrap decrypts the data key, or returns errKeyMismatch if the data key
+	// was not wrapped by this key
+	unwrap(ctx context.Context, wrapped *keyWrap) ([]byte, error)
+}
+
+// dataKeyGenerator creates data keys along with their wrapped form
+type dataKeyGenerator interface {
+	generate(ctx context.Context) ([]byte, *keyWrap, error)
+}
+
+// errKeyMismatch is returned by keyWrapper.unwrap for data keys wrapped by another key
+var errKeyMismatch = errors.New("data key was wrapped by a different key")
+
+// Encryptor encrypts snapshots with the configured keys and decrypts snapshots
+// written with any of the configured or previous keys
+type Encryptor struct {
+	// generator creates the data keys if they are not generated locally
+	generator  dataKeyGenerator
+	wrappers   []keyWrapper
+	unwrappers []keyWrapper
+}
+
+// NewEncryptor sets up the keys of the encryption configuration.  Vault Transit
+// requests are sent with the client of s.
+func NewEncryptor(config *config.Configuration, s *Snapshotter) (*Encryptor, error) {
+	e := &Encryptor{}
+	c := config.Encryption
+	if c.KeyFile != "" {
+		key, err := readStaticKey(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		e.wrappers = append(e.wrappers, key)
+		e.unwrappers = append(e.unwrappers, key)
+	}
+	for _, file := range c.DecryptionKeyFiles {
+		key, err := readStaticKey(file)
+		if err != nil {
+			return nil, err
+		}
+		e.unwrappers = append(e.unwrappers, key)
+	}
+	if len(c.AgeRecipients) > 0 {
+		recipients, err := parseAgeRecipients(c.AgeRecipients)
+		if err != nil {
+			return nil, err
+		}
+		e.wrappers = append(e.wrappers, recipients)
+	}
+	if c.AgeIdentityFile != "" {
+		identities, err := readAgeIdentities(c.AgeIdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		e.unwrappers = append(e.unwrappers, identities)
+	}
+	if c.TransitKey != "" {
+		transit := newTransitKey(s, c.TransitMount, c.TransitKey)
+		if c.TransitDataKey {
+			e.generator = transit
+		} else {
+			e.wrappers = append(e.wrappers, transit)
+		}
+		e.unwrappers = append(e.unwrappers, transit)
+	} else if c.TransitDataKey {
+		return nil, errors.New("transit_datakey requires a transit_key")
+	}
+	return e, nil
+}
+
+// Enabled reports whether snapshots are encrypted
+func (e *Encryptor) Enabled() bool {
+	return e.generator != nil || len(e.wrappers) > 0
+}
+
+// Encrypt returns a writer that encrypts everything written to it into w under
+// a new data key.  Closing it writes the last chunk, but does not close w.
+func (e *Encryptor) Encrypt(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	dataKey, keys, err := e.newDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	header := &encryptionHeader{
+		Version:     1,
+		Cipher:      encryptionCipher,
+		ChunkSize:   encryptionChunkSize,
+		NoncePrefix: make([]byte, noncePrefixSize),
+		Keys:        keys,
+	}
+	if _, err := rand.Read(header.NoncePrefix); err != nil {
+		return nil, err
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newChunkCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, len(encryptionMagic)+4)
+	copy(prefix, encryptionMagic)
+	binary.BigEndian.PutUint32(prefix[len(encryptionMagic):], uint32(len(headerJSON)))
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(headerJSON); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		stream: newChunkStream(header, headerJSON),
+		buf:    make([]byte, 0, header.ChunkSize),
+	}, nil
+}
+
+// newDataKey creates a data key and wraps it with every configured key
+func (e *Encryptor) newDataKey(ctx context.Context) ([]byte, []*keyWrap, error) {
+	var dataKey []byte
+	var keys []*keyWrap
+	if e.generator != nil {
+		generated, wrapped, err := e.generator.generate(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to generate data key: %v", err)
+		}
+		if len(generated) != dataKeySize {
+			return nil, nil, errors.New("unable to generate data key: invalid key size")
+		}
+		dataKey = generated
+		keys = append(keys, wrapped)
+	} else {
+		dataKey = make([]byte, dataKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, wrapper := range e.wrappers {
+		wrapped, err := wrapper.wrap(ctx, dataKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to wrap data key: %v", err)
+		}
+		keys = append(keys, wrapped)
+	}
+	return dataKey, keys, nil
+}
+
+// Decrypt returns a reader of the decrypted snapshot read from r.  Snapshots
+// that are not encrypted are passed through unchanged, so that snapshots taken
+// before encryption was enabled can still be restored.
+func (e *Encryptor) Decrypt(ctx context.Context, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, encryptionChunkSize+encryptionTagSize+1)
+	magic, err := br.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, encryptionMagic) {
+		return br, nil
+	}
+
+	prefix := make([]byte, len(encryptionMagic)+4)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, fmt.Errorf("unable to read encryption header: %v", err)
+	}
+	headerSize := binary.BigEndian.Uint32(prefix[len(encryptionMagic):])
+	if headerSize > maxHeaderSize {
+		return nil, fmt.Errorf("encryption header of %d bytes is too large", headerSize)
+	}
+	headerJSON := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, headerJSON); err != nil {
+		return nil, fmt.Errorf("unable to read encryption header: %v", err)
+	}
+	header := &encryptionHeader{}
+	if err := json.Unmarshal(headerJSON, header); err != nil {
+		return nil, fmt.Errorf("unable to parse encryption header: %v", err)
+	}
+	if header.Version != 1 || header.Cipher != encryptionCipher {
+		return nil, fmt.Errorf("unsupported encryption version %d with cipher %s", header.Version, header.Cipher)
+	}
+	if header.ChunkSize <= 0 || header.ChunkSize > encryptionChunkSize || len(header.NoncePrefix) != noncePrefixSize {
+		return nil, errors.New("invalid encryption header")
+	}
+
+	dataKey, err := e.unwrapDataKey(ctx, header.Keys)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newChunkCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		r:      br,
+		aead:   aead,
+		stream: newChunkStream(header, headerJSON),
+		chunk:  make([]byte, header.ChunkSize+encryptionTagSize),
+	}, nil
+}
+
+// unwrapDataKey decrypts the data key with the first configured key it was wrapped by
+func (e *Encryptor) unwrapDataKey(ctx context.Context, keys []*keyWrap) ([]byte, error) {
+	var errs []error
+	for _, wrapped := range keys {
+		for _, unwrapper := range e.unwrappers {
+			dataKey, err := unwrapper.unwrap(ctx, wrapped)
+			if err == errKeyMismatch {
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s key: %v", wrapped.Type, err))
+				continue
+			}
+			if len(dataKey) != dataKeySize {
+				errs = append(errs, fmt.Errorf("%s key: invalid data key", wrapped.Type))
+				continue
+			}
+			return dataKey, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("unable to decrypt snapshot: %v", errs)
+	}
+	types := make([]string, len(keys))
+	for i, wrapped := range keys {
+		types[i] = wrapped.Type
+	}
+	return nil, fmt.Errorf("unable to decrypt snapshot: none of the configured keys match its %v keys", types)
+}
+
+func newChunkCipher(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkStream derives the nonce of every chunk
+type chunkStream struct {
+	nonce   []byte
+	counter uint32
+	aad     []byte
+}
+
+func newChunkStream(header *encryptionHeader, headerJSON []byte) *chunkStream {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, header.NoncePrefix)
+	return &chunkStream{nonce: nonce, aad: headerJSON}
+}
+
+func (s *chunkStream) next(last bool) ([]byte, error) {
+	if s.counter == ^uint32(0) {
+		return nil, errors.New("snapshot is too large to encrypt")
+	}
+	binary.BigEndian.PutUint32(s.nonce[noncePrefixSize:], s.counter)
+	s.nonce[noncePrefixSize+4] = 0
+	if last {
+		s.nonce[noncePrefixSize+4] = 1
+	}
+	s.counter++
+	return s.nonce, nil
+}
+
+// encryptingWriter seals full chunks once more data follows them, so that the
+// last chunk is only sealed on Close
+type encryptingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	stream *chunkStream
+	buf    []byte
+	out    []byte
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == cap(e.buf) {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	nonce, err := e.stream.next(last)
+	if err != nil {
+		return err
+	}
+	e.out = e.aead.Seal(e.out[:0], nonce, e.buf, e.stream.aad)
+	e.buf = e.buf[:0]
+	_, err = e.w.Write(e.out)
+	return err
+}
+
+// decryptingReader opens chunks one at a time and fails if the snapshot ends
+// without its last chunk
+type decryptingReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	stream *chunkStream
+	chunk  []byte
+	plain  []byte
+	done   bool
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	last := false
+	switch err {
+	case nil:
+		// a full chunk is the last one if nothing follows it
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF, io.EOF:
+		last = true
+	default:
+		return err
+	}
+	if n < encryptionTagSize {
+		return errors.New("encrypted snapshot is truncated")
+	}
+	nonce, err := d.stream.next(last)
+	if err != nil {
+		return err
+	}
+	d.plain, err = d.aead.Open(d.chunk[:0], nonce, d.chunk[:n], d.stream.aad)
+	if err != nil {
+		return errors.New("encrypted snapshot is corrupt or truncated")
+	}
+	d.done = last
+	return nil
+}
@@ -0,0 +1,218 @@
+package snapshot_agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+)
+
+// writeStaticKey writes a new random key in the format of key_file
+func writeStaticKey(t *testing.T, dir, name string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newTestEncryptor(t *testing.T, c config.EncryptionConfig) *Encryptor {
+	t.Helper()
+	e, err := NewEncryptor(&config.Configuration{Encryption: c}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func encrypt(t *testing.T, e *Encryptor, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := e.Encrypt(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(e *Encryptor, encrypted []byte) ([]byte, error) {
+	r, err := e.Decrypt(context.Background(), bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// chunksOffset returns where the encrypted chunks start after the header
+func chunksOffset(encrypted []byte) int {
+	headerSize := binary.BigEndian.Uint32(encrypted[len(encryptionMagic):])
+	return len(encryptionMagic) + 4 + int(headerSize)
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	e := newTestEncryptor(t, config.EncryptionConfig{KeyFile: writeStaticKey(t, dir, "key")})
+	sizes := []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize}
+	for _, size := range sizes {
+		plain := randomBytes(t, size)
+		encrypted := encrypt(t, e, plain)
+		if !bytes.HasPrefix(encrypted, encryptionMagic) {
+			t.Fatalf("size %d: encrypted snapshot does not start with the magic", size)
+		}
+		chunks := size/encryptionChunkSize + 1
+		if size > 0 && size%encryptionChunkSize == 0 {
+			chunks--
+		}
+		if want := chunksOffset(encrypted) + size + chunks*encryptionTagSize; len(encrypted) != want {
+			t.Errorf("size %d: got %d encrypted bytes, want %d", size, len(encrypted), want)
+		}
+		decrypted, err := decrypt(e, encrypted)
+		if err != nil {
+			t.Fatalf("size %d: unexpected error: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("size %d: decrypted snapshot differs from the original", size)
+		}
+	}
+}
+
+func TestDecryptUnencrypted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	e := newTestEncryptor(t, config.EncryptionConfig{KeyFile: writeStaticKey(t, dir, "key")})
+	for _, plain := range [][]byte{{}, []byte("VRS"), randomBytes(t, encryptionChunkSize+1)} {
+		decrypted, err := decrypt(e, plain)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("unencrypted snapshot of %d bytes was not passed through", len(plain))
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	e := newTestEncryptor(t, config.EncryptionConfig{KeyFile: writeStaticKey(t, dir, "key")})
+	full := 2 * encryptionChunkSize
+	partial := encrypt(t, e, randomBytes(t, full+100))
+	exact := encrypt(t, e, randomBytes(t, full))
+	sealedChunk := encryptionChunkSize + encryptionTagSize
+
+	corrupt := append([]byte(nil), partial...)
+	corrupt[chunksOffset(corrupt)+10] ^= 0xff
+	reordered := append([]byte(nil), exact...)
+	first := chunksOffset(reordered)
+	chunk := append([]byte(nil), reordered[first:first+sealedChunk]...)
+	copy(reordered[first:], reordered[first+sealedChunk:first+2*sealedChunk])
+	copy(reordered[first+sealedChunk:], chunk)
+
+	tests := []struct {
+		name      string
+		encrypted []byte
+	}{
+		{"in header", partial[:chunksOffset(partial)-1]},
+		{"without chunks", partial[:chunksOffset(partial)]},
+		{"within last chunk", partial[:len(partial)-1]},
+		{"at chunk boundary", partial[:chunksOffset(partial)+2*sealedChunk]},
+		{"full chunks at chunk boundary", exact[:chunksOffset(exact)+sealedChunk]},
+		{"appended chunk", append(append([]byte(nil), exact...), exact[chunksOffset(exact):chunksOffset(exact)+sealedChunk]...)},
+		{"corrupt", corrupt},
+		{"reordered", reordered},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decrypt(e, test.encrypted); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecryptRotatedKey(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	oldKey := writeStaticKey(t, dir, "old")
+	newKey := writeStaticKey(t, dir, "new")
+	plain := randomBytes(t, encryptionChunkSize+1)
+	encrypted := encrypt(t, newTestEncryptor(t, config.EncryptionConfig{KeyFile: oldKey}), plain)
+
+	rotated := newTestEncryptor(t, config.EncryptionConfig{KeyFile: newKey, DecryptionKeyFiles: []string{oldKey}})
+	decrypted, err := decrypt(rotated, encrypted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Error("decrypted snapshot differs from the original")
+	}
+
+	// new snapshots are only encrypted with the current key
+	decrypted, err = decrypt(newTestEncryptor(t, config.EncryptionConfig{KeyFile: newKey}), encrypt(t, rotated, plain))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Error("decrypted snapshot differs from the original")
+	}
+	if _, err := decrypt(newTestEncryptor(t, config.EncryptionConfig{KeyFile: oldKey}), encrypt(t, rotated, plain)); err == nil {
+		t.Error("expected previous keys not to encrypt new snapshots")
+	}
+
+	_, err = decrypt(newTestEncryptor(t, config.EncryptionConfig{KeyFile: newKey}), encrypted)
+	if err == nil || !strings.Contains(err.Error(), "none of the configured keys match") {
+		t.Errorf("got error %v, want a key mismatch", err)
+	}
+}
+
+func TestReadStaticKeyErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	short := filepath.Join(dir, "short")
+	if err := ioutil.WriteFile(short, []byte(base64.StdEncoding.EncodeToString([]byte("too short"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{short, filepath.Join(dir, "missing")} {
+		if _, err := readStaticKey(file); err == nil {
+			t.Errorf("expected an error for %s", filepath.Base(file))
+		}
+	}
+}
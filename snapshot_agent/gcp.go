@@ -1,94 +1,107 @@
 package snapshot_agent
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"log"
-	"sort"
+	"io"
 
 	"cloud.google.com/go/storage"
 	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
-// CreateGCPSnapshot writes snapshot to google storage
-func (s *Snapshotter) CreateGCPSnapshot(b *bytes.Buffer, config *config.Configuration, currentTs int64) (string, error) {
-	fileName := fmt.Sprintf("raft_snapshot-%d.snap", currentTs)
-	obj := s.GCPBucket.Object(fileName)
-	w := obj.NewWriter(context.Background())
+func init() {
+	RegisterStorage("gcp", newGCPStorage)
+}
+
+// gcpStorage writes snapshots to a google storage bucket
+type gcpStorage struct {
+	bucket     *storage.BucketHandle
+	bucketName string
+	chunkSize  int
+}
+
+func newGCPStorage(config *config.Configuration) (Storage, error) {
+	if config.GCP.Bucket == "" {
+		return nil, nil
+	}
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpStorage{
+		bucket:     client.Bucket(config.GCP.Bucket),
+		bucketName: config.GCP.Bucket,
+		chunkSize:  googleapi.DefaultUploadChunkSize,
+	}, nil
+}
+
+// Upload writes snapshot to google storage
+func (g *gcpStorage) Upload(ctx context.Context, reader io.Reader, fileName string) (string, error) {
+	// canceling the writer's context is the only way to abort the upload,
+	// closing it would commit whatever was written so far
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	obj := g.bucket.Object(fileName)
+	w := obj.NewWriter(ctx)
+	w.ChunkSize = g.chunkSize
 
-	if _, err := w.Write(b.Bytes()); err != nil {
+	if _, err := io.Copy(w, reader); err != nil {
 		return "", err
 	}
 
 	if err := w.Close(); err != nil {
 		return "", err
 	}
+	return fileName, nil
+}
 
-	if config.Retain > 0 {
-		deleteCtx := context.Background()
-		query := &storage.Query{Prefix: "raft_snapshot-"}
-		it := s.GCPBucket.Objects(deleteCtx, query)
-		var files []storage.ObjectAttrs
-		for {
-			attrs, err := it.Next()
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				log.Println("Unable to iterate through bucket to find old snapshots to delete")
-				return fileName, err
-			}
-			files = append(files, *attrs)
-		}
-
-		timestamp := func(o1, o2 *storage.ObjectAttrs) bool {
-			return o1.Updated.Before(o2.Updated)
+func (g *gcpStorage) List(ctx context.Context) ([]SnapshotInfo, error) {
+	query := &storage.Query{Prefix: "raft_snapshot-"}
+	it := g.bucket.Objects(ctx, query)
+	snapshots := make([]SnapshotInfo, 0)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
 		}
-
-		GCPBy(timestamp).Sort(files)
-		if len(files)-int(config.Retain) <= 0 {
-			return fileName, nil
+		if err != nil {
+			return nil, err
 		}
-		snapshotsToDelete := files[0 : len(files)-int(config.Retain)]
-
-		for _, ss := range snapshotsToDelete {
-			obj := s.GCPBucket.Object(ss.Name)
-			err := obj.Delete(deleteCtx)
-			if err != nil {
-				log.Println("Cannot delete old snapshot")
-				return fileName, err
-			}
+		if isSnapshotName(attrs.Name) {
+			snapshots = append(snapshots, SnapshotInfo{Name: attrs.Name, LastModified: attrs.Updated})
 		}
 	}
-	return fileName, nil
+	return snapshots, nil
 }
 
-// implementation of Sort interface for s3 objects
-type GCPBy func(f1, f2 *storage.ObjectAttrs) bool
-
-func (by GCPBy) Sort(objects []storage.ObjectAttrs) {
-	fs := &gcpObjectSorter{
-		objects: objects,
-		by:      by, // The Sort method's receiver is the function (closure) that defines the sort order.
-	}
-	sort.Sort(fs)
+func (g *gcpStorage) Delete(ctx context.Context, name string) error {
+	return g.bucket.Object(name).Delete(ctx)
 }
 
-type gcpObjectSorter struct {
-	objects []storage.ObjectAttrs
-	by      func(f1, f2 *storage.ObjectAttrs) bool // Closure used in the Less method.
+func (g *gcpStorage) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	return g.bucket.Object(name).NewReader(ctx)
 }
 
-func (s *gcpObjectSorter) Len() int {
-	return len(s.objects)
+func (g *gcpStorage) Check(ctx context.Context) error {
+	_, err := g.bucket.Attrs(ctx)
+	return err
 }
 
-func (s *gcpObjectSorter) Less(i, j int) bool {
-	return s.by(&s.objects[i], &s.objects[j])
+// SetBufferLimit shrinks the upload chunk, which is buffered in memory, to fit into limit
+func (g *gcpStorage) SetBufferLimit(limit int64) error {
+	chunkSize := int(limit) - int(limit)%googleapi.MinUploadChunkSize
+	if chunkSize < googleapi.MinUploadChunkSize {
+		return fmt.Errorf("need at least %d bytes", googleapi.MinUploadChunkSize)
+	}
+	if chunkSize < g.chunkSize {
+		g.chunkSize = chunkSize
+	}
+	return nil
 }
 
-func (s *gcpObjectSorter) Swap(i, j int) {
-	s.objects[i], s.objects[j] = s.objects[j], s.objects[i]
+func (g *gcpStorage) Describe() string {
+	return fmt.Sprintf("gs://%s", g.bucketName)
 }
@@ -0,0 +1,237 @@
+package snapshot_agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// staticKey wraps data keys with AES-256-GCM under a key read from a file.  Its
+// ID is derived from the key, so that previous keys can be kept around to
+// decrypt older snapshots after a rotation.
+type staticKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func readStaticKey(file string) (*staticKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read encryption key: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption key in %s must be 32 bytes encoded in base64", file)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &staticKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+func (k *staticKey) wrap(ctx context.Context, dataKey []byte) (*keyWrap, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &keyWrap{Type: "static", KeyID: k.id, Data: k.aead.Seal(nonce, nonce, dataKey, nil)}, nil
+}
+
+func (k *staticKey) unwrap(ctx context.Context, wrapped *keyWrap) ([]byte, error) {
+	if wrapped.Type != "static" || wrapped.KeyID != k.id {
+		return nil, errKeyMismatch
+	}
+	nonceSize := k.aead.NonceSize()
+	if len(wrapped.Data) < nonceSize {
+		return nil, errors.New("wrapped data key is truncated")
+	}
+	return k.aead.Open(nil, wrapped.Data[:nonceSize], wrapped.Data[nonceSize:], nil)
+}
+
+// ageRecipients wraps data keys for age X25519 recipients
+type ageRecipients struct {
+	recipients []age.Recipient
+}
+
+func parseAgeRecipients(keys []string) (*ageRecipients, error) {
+	r := &ageRecipients{}
+	for _, key := range keys {
+		recipient, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %v", key, err)
+		}
+		r.recipients = append(r.recipients, recipient)
+	}
+	return r, nil
+}
+
+func (r *ageRecipients) wrap(ctx context.Context, dataKey []byte) (*keyWrap, error) {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, r.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &keyWrap{Type: "age", Data: buf.Bytes()}, nil
+}
+
+func (r *ageRecipients) unwrap(ctx context.Context, wrapped *keyWrap) ([]byte, error) {
+	return nil, errKeyMismatch
+}
+
+// ageIdentities unwraps data keys with age private keys
+type ageIdentities struct {
+	identities []age.Identity
+}
+
+func readAgeIdentities(file string) (*ageIdentities, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read age identities: %v", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse age identities in %s: %v", file, err)
+	}
+	return &ageIdentities{identities: identities}, nil
+}
+
+func (i *ageIdentities) wrap(ctx context.Context, dataKey []byte) (*keyWrap, error) {
+	return nil, errors.New("age identities cannot wrap data keys")
+}
+
+func (i *ageIdentities) unwrap(ctx context.Context, wrapped *keyWrap) ([]byte, error) {
+	if wrapped.Type != "age" {
+		return nil, errKeyMismatch
+	}
+	r, err := age.Decrypt(bytes.NewReader(wrapped.Data), i.identities...)
+	if _, ok := err.(*age.NoIdentityMatchError); ok {
+		return nil, errKeyMismatch
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// transitKey wraps data keys with a Vault Transit key.  Vault keeps all versions
+// of a rotated key, so older snapshots stay decryptable unless the minimum
+// decryption version of the key is raised.
+type transitKey struct {
+	s     *Snapshotter
+	mount string
+	name  string
+}
+
+func newTransitKey(s *Snapshotter, mount, name string) *transitKey {
+	if mount == "" {
+		mount = "transit"
+	}
+	return &transitKey{s: s, mount: strings.Trim(mount, "/"), name: name}
+}
+
+func (k *transitKey) wrap(ctx context.Context, dataKey []byte) (*keyWrap, error) {
+	secret, err := k.write(ctx, "encrypt", map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return nil, errors.New("Vault Transit returned no ciphertext")
+	}
+	return &keyWrap{Type: "transit", Mount: k.mount, KeyID: k.name, Data: []byte(ciphertext)}, nil
+}
+
+// generate obtains a new data key from Transit, which returns it both in
+// plaintext and wrapped by the Transit key
+func (k *transitKey) generate(ctx context.Context) ([]byte, *keyWrap, error) {
+	secret, err := k.write(ctx, "datakey/plaintext", map[string]interface{}{
+		"bits": dataKeySize * 8,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, nil, errors.New("Vault Transit returned no plaintext")
+	}
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return nil, nil, errors.New("Vault Transit returned no ciphertext")
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, &keyWrap{Type: "transit", Mount: k.mount, KeyID: k.name, Data: []byte(ciphertext)}, nil
+}
+
+func (k *transitKey) unwrap(ctx context.Context, wrapped *keyWrap) ([]byte, error) {
+	if wrapped.Type != "transit" {
+		return nil, errKeyMismatch
+	}
+	// the key that wrapped the data key is used even if the configuration
+	// changed since, so that moving to a new Transit key keeps older snapshots
+	// decryptable
+	k = &transitKey{s: k.s, mount: wrapped.Mount, name: wrapped.KeyID}
+	secret, err := k.write(ctx, "decrypt", map[string]interface{}{
+		"ciphertext": string(wrapped.Data),
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, errors.New("Vault Transit returned no plaintext")
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+func (k *transitKey) write(ctx context.Context, operation string, data map[string]interface{}) (*vaultApi.Secret, error) {
+	req := k.s.API.NewRequest("PUT", "/v1/"+k.mount+"/"+operation+"/"+k.name)
+	if err := req.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	resp, err := k.s.API.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := vaultApi.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("empty response from Vault Transit")
+	}
+	return secret, nil
+}
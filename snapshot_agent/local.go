@@ -1,78 +1,96 @@
 package snapshot_agent
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
-	"sort"
-	"strings"
 
 	"github.com/Lucretius/vault_raft_snapshot_agent/config"
 )
 
-// CreateLocalSnapshot writes snapshot to disk location
-func (s *Snapshotter) CreateLocalSnapshot(buf *bytes.Buffer, config *config.Configuration, currentTs int64) (string, error) {
-	fileName := fmt.Sprintf("%s/raft_snapshot-%d.snap", config.Local.Path, currentTs)
-	err := ioutil.WriteFile(fileName, buf.Bytes(), 0644)
+func init() {
+	RegisterStorage("local", newLocalStorage)
+}
+
+// localStorage writes snapshots to a directory on disk
+type localStorage struct {
+	path string
+}
+
+func newLocalStorage(config *config.Configuration) (Storage, error) {
+	if config.Local.Path == "" {
+		return nil, nil
+	}
+	return &localStorage{path: config.Local.Path}, nil
+}
+
+// Upload writes snapshot to disk location
+func (l *localStorage) Upload(ctx context.Context, reader io.Reader, fileName string) (string, error) {
+	filePath := fmt.Sprintf("%s/%s", l.path, fileName)
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, &contextReader{ctx: ctx, reader: reader})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		// do not leave a truncated snapshot behind
+		os.Remove(filePath)
 		return "", err
-	} else {
-		if config.Retain > 0 {
-			fileInfo, err := ioutil.ReadDir(config.Local.Path)
-			filesToDelete := make([]os.FileInfo, 0)
-			for _, file := range fileInfo {
-				if strings.Contains(file.Name(), "raft_snapshot-") && strings.HasSuffix(file.Name(), ".snap") {
-					filesToDelete = append(filesToDelete, file)
-				}
-			}
-			if err != nil {
-				log.Println("Unable to read file directory to delete old snapshots")
-				return fileName, err
-			}
-			timestamp := func(f1, f2 *os.FileInfo) bool {
-				file1 := *f1
-				file2 := *f2
-				return file1.ModTime().Before(file2.ModTime())
-			}
-			By(timestamp).Sort(filesToDelete)
-			if len(filesToDelete) <= int(config.Retain) {
-				return fileName, nil
-			}
-			filesToDelete = filesToDelete[0 : len(filesToDelete)-int(config.Retain)]
-			for _, f := range filesToDelete {
-				os.Remove(fmt.Sprintf("%s/%s", config.Local.Path, f.Name()))
-			}
+	}
+	return filePath, nil
+}
+
+func (l *localStorage) List(ctx context.Context) ([]SnapshotInfo, error) {
+	fileInfo, err := ioutil.ReadDir(l.path)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]SnapshotInfo, 0)
+	for _, file := range fileInfo {
+		if file.Mode().IsRegular() && isSnapshotName(file.Name()) {
+			snapshots = append(snapshots, SnapshotInfo{Name: file.Name(), LastModified: file.ModTime()})
 		}
-		return fileName, nil
 	}
+	return snapshots, nil
 }
 
-// implementation of Sort interface for fileInfo
-type By func(f1, f2 *os.FileInfo) bool
+func (l *localStorage) Delete(ctx context.Context, name string) error {
+	return os.Remove(fmt.Sprintf("%s/%s", l.path, name))
+}
 
-func (by By) Sort(files []os.FileInfo) {
-	fs := &fileSorter{
-		files: files,
-		by:    by, // The Sort method's receiver is the function (closure) that defines the sort order.
-	}
-	sort.Sort(fs)
+func (l *localStorage) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(fmt.Sprintf("%s/%s", l.path, name))
 }
 
-type fileSorter struct {
-	files []os.FileInfo
-	by    func(f1, f2 *os.FileInfo) bool // Closure used in the Less method.
+func (l *localStorage) Check(ctx context.Context) error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", l.path)
+	}
+	return nil
 }
 
-func (s *fileSorter) Len() int {
-	return len(s.files)
+func (l *localStorage) Describe() string {
+	return l.path
 }
 
-func (s *fileSorter) Less(i, j int) bool {
-	return s.by(&s.files[i], &s.files[j])
+// contextReader stops reading once its context is canceled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
 }
 
-func (s *fileSorter) Swap(i, j int) {
-	s.files[i], s.files[j] = s.files[j], s.files[i]
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
 }
@@ -0,0 +1,75 @@
+package snapshot_agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"github.com/hashicorp/go-hclog"
+)
+
+// baseLogger is used for everything that is not part of a snapshot run
+var baseLogger = hclog.New(&hclog.LoggerOptions{Level: hclog.Info})
+
+type (
+	loggerKey struct{}
+	runIDKey  struct{}
+)
+
+// ConfigureLogging sets the level and format of the agent's logs.  Output of
+// the standard log package, e.g. from dependencies, is routed through the same
+// logger.
+func ConfigureLogging(config *config.Configuration) error {
+	level := hclog.Info
+	if config.LogLevel != "" {
+		level = hclog.LevelFromString(config.LogLevel)
+		if level == hclog.NoLevel {
+			return fmt.Errorf("invalid log_level %q", config.LogLevel)
+		}
+	}
+	var jsonFormat bool
+	switch config.LogFormat {
+	case "", "text":
+	case "json":
+		jsonFormat = true
+	default:
+		return fmt.Errorf("invalid log_format %q, must be text or json", config.LogFormat)
+	}
+	baseLogger = hclog.New(&hclog.LoggerOptions{Level: level, JSONFormat: jsonFormat})
+	log.SetFlags(0)
+	log.SetOutput(baseLogger.StandardWriter(&hclog.StandardLoggerOptions{InferLevels: true}))
+	return nil
+}
+
+// Logger returns the logger of ctx, which carries the fields of the current
+// snapshot run
+func Logger(ctx context.Context) hclog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(hclog.Logger); ok {
+		return logger
+	}
+	return baseLogger
+}
+
+// WithLogFields returns a context whose logger adds the given key/value pairs
+// to every line
+func WithLogFields(ctx context.Context, args ...interface{}) context.Context {
+	return context.WithValue(ctx, loggerKey{}, Logger(ctx).With(args...))
+}
+
+// WithRunID starts a snapshot run, whose ID is attached to every line logged with ctx
+func WithRunID(ctx context.Context) (context.Context, string) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	runID := hex.EncodeToString(id)
+	ctx = context.WithValue(ctx, runIDKey{}, runID)
+	return WithLogFields(ctx, "run_id", runID), runID
+}
+
+// RunID returns the ID of the snapshot run of ctx, if any
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
@@ -0,0 +1,118 @@
+package snapshot_agent
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "vault_raft_snapshot_agent"
+
+var (
+	snapshotAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_attempts_total",
+		Help:      "Number of snapshots attempted per destination.",
+	}, []string{"destination"})
+	snapshotSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_successes_total",
+		Help:      "Number of snapshots successfully written per destination.",
+	}, []string{"destination"})
+	snapshotFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_failures_total",
+		Help:      "Number of snapshots that failed per destination, after all retries.",
+	}, []string{"destination"})
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last snapshot successfully written per destination.",
+	}, []string{"destination"})
+	snapshotSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "snapshot_size_bytes",
+		Help:      "Size of the last snapshot fetched from Vault.",
+	})
+	fetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_fetch_duration_seconds",
+		Help:      "Duration of streaming a snapshot from Vault, including waiting for the destinations to read it.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	})
+	uploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Duration of uploading a snapshot per destination.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"destination"})
+	retentionDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retention_deletions_total",
+		Help:      "Number of snapshots deleted by the retention policy per destination.",
+	}, []string{"destination"})
+	tokenRenewals = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_renewals_total",
+		Help:      "Number of times the Vault token was renewed.",
+	})
+	vaultLogins = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_logins_total",
+		Help:      "Number of times the agent logged in to Vault to obtain a new token.",
+	})
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Whether this node was the leader of the Vault cluster at the last check.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		snapshotAttempts,
+		snapshotSuccesses,
+		snapshotFailures,
+		lastSuccess,
+		snapshotSize,
+		fetchDuration,
+		uploadDuration,
+		retentionDeletions,
+		tokenRenewals,
+		vaultLogins,
+		isLeader,
+	)
+}
+
+// initDestinationMetrics exports the per destination metrics before the first
+// snapshot, so that alerts on missing successes also fire for new agents
+func initDestinationMetrics(destinations []Destination) {
+	for _, dest := range destinations {
+		snapshotAttempts.WithLabelValues(dest.Name)
+		snapshotSuccesses.WithLabelValues(dest.Name)
+		snapshotFailures.WithLabelValues(dest.Name)
+		retentionDeletions.WithLabelValues(dest.Name)
+	}
+}
+
+// recordRun updates the per destination metrics with the outcome of a snapshot
+func (s *Snapshotter) recordRun(run *SnapshotRun, err error) {
+	now := float64(time.Now().Unix())
+	if err != nil || run == nil || len(run.Results) == 0 {
+		for _, dest := range s.Destinations {
+			snapshotAttempts.WithLabelValues(dest.Name).Inc()
+			snapshotFailures.WithLabelValues(dest.Name).Inc()
+		}
+		return
+	}
+	for _, result := range run.Results {
+		snapshotAttempts.WithLabelValues(result.Destination).Inc()
+		// a snapshot that was written counts as success even if pruning failed
+		if result.Location != "" {
+			snapshotSuccesses.WithLabelValues(result.Destination).Inc()
+			lastSuccess.WithLabelValues(result.Destination).Set(now)
+		} else {
+			snapshotFailures.WithLabelValues(result.Destination).Inc()
+		}
+	}
+}
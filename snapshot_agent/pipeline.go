@@ -0,0 +1,255 @@
+package snapshot_agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"github.com/hashicorp/raft"
+)
+
+// errDestinationClosed is returned to the snapshot stream once a destination
+// has stopped reading, either because it failed or finished early
+var errDestinationClosed = errors.New("destination stopped reading the snapshot")
+
+// errAllDestinationsFailed aborts the snapshot stream when nobody is left to read it
+var errAllDestinationsFailed = errors.New("all snapshot destinations failed")
+
+// SnapshotResult is the outcome of writing a snapshot to a single destination
+type SnapshotResult struct {
+	Destination string
+	// Name is the file name of the snapshot, set once it was written
+	Name     string
+	Location string
+	// Deleted lists the snapshots removed by the retention policy afterwards
+	Deleted []SnapshotInfo
+	Err     error
+}
+
+// SnapshotRun is the outcome of taking a snapshot and writing it to all destinations
+type SnapshotRun struct {
+	// Meta is the raft metadata of the snapshot, set once it has been verified
+	Meta *raft.SnapshotMeta
+	// Size is the size of the snapshot in bytes
+	Size    int64
+	Results []SnapshotResult
+}
+
+// TakeSnapshot writes a raft snapshot from Vault to every configured destination
+// concurrently.  Each destination receives the full byte stream and reports its
+// own result.  The returned error is only set if the snapshot itself could not be
+// read from Vault or failed verification, in which case every destination also
+// fails and nothing is pruned.
+//
+// By default the snapshot is streamed to the destinations without being held in
+// memory, and the uploads are only completed once the archive has been verified.
+// If a scratch path is configured, it is first written to a temporary file there
+// and verified, after which every destination reads the file independently.
+//
+// Failures are retried according to the retry policy.  A streamed snapshot can
+// not be read twice, so destinations that failed receive a new snapshot, while
+// uploads from a scratch file are retried from the same file.
+//
+// Canceling the context aborts the snapshot and all uploads.
+func (s *Snapshotter) TakeSnapshot(ctx context.Context, config *config.Configuration) (*SnapshotRun, error) {
+	run, err := s.takeSnapshot(ctx, config)
+	s.recordRun(run, err)
+	return run, err
+}
+
+func (s *Snapshotter) takeSnapshot(ctx context.Context, config *config.Configuration) (*SnapshotRun, error) {
+	run := &SnapshotRun{}
+	if len(s.Destinations) == 0 {
+		return run, nil
+	}
+	if config.ScratchPath != "" {
+		err := s.Retry.Do(ctx, "take snapshot", func() error {
+			var err error
+			run, err = s.snapshotViaScratchFile(ctx, config, time.Now().UnixNano())
+			return err
+		})
+		return run, err
+	}
+
+	pending := s.Destinations
+	var failed []SnapshotResult
+	err := s.Retry.Do(ctx, "take snapshot", func() error {
+		attempt, err := s.streamSnapshot(ctx, config, pending, time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+		run.Meta = attempt.Meta
+		run.Size = attempt.Size
+		retry := make([]Destination, 0)
+		failed = failed[:0]
+		for i, result := range attempt.Results {
+			// a destination with a location was written and only failed pruning,
+			// which is not worth uploading another snapshot for
+			if result.Err != nil && result.Location == "" {
+				retry = append(retry, pending[i])
+				failed = append(failed, result)
+			} else {
+				run.Results = append(run.Results, result)
+			}
+		}
+		pending = retry
+		if len(failed) > 0 {
+			return fmt.Errorf("upload failed on %d destinations", len(failed))
+		}
+		return nil
+	})
+	if len(failed) > 0 {
+		// the individual destination failures are reported in the results
+		run.Results = append(run.Results, failed...)
+		err = nil
+	}
+	return run, err
+}
+
+// streamSnapshot tees the snapshot stream from Vault into the verifier and one
+// pipe per destination
+func (s *Snapshotter) streamSnapshot(ctx context.Context, config *config.Configuration, destinations []Destination, now int64) (*SnapshotRun, error) {
+	run := &SnapshotRun{Results: make([]SnapshotResult, len(destinations))}
+	writers := make([]*io.PipeWriter, len(destinations))
+
+	var wg sync.WaitGroup
+	for i, dest := range destinations {
+		reader, writer := io.Pipe()
+		writers[i] = writer
+		wg.Add(1)
+		go func(i int, dest Destination, reader *io.PipeReader) {
+			defer wg.Done()
+			name, location, deleted, err := s.CreateSnapshot(ctx, dest, reader, config, now)
+			// unblock the stream if the destination returned without consuming everything
+			reader.CloseWithError(errDestinationClosed)
+			run.Results[i] = SnapshotResult{Destination: dest.Name, Name: name, Location: location, Deleted: deleted, Err: err}
+		}(i, dest, reader)
+	}
+
+	verifier := newSnapshotVerifier()
+	var output io.WriteCloser = nopWriteCloser{newFanOutWriter(writers)}
+	var err error
+	if s.Encryptor.Enabled() {
+		output, err = s.Encryptor.Encrypt(ctx, output)
+	}
+	if err == nil {
+		run.Size, err = s.fetchRaftSnapshot(ctx, io.MultiWriter(verifier, output))
+	}
+	// the destinations only see the end of the stream once the archive is verified,
+	// so a corrupt snapshot makes every upload fail instead of completing
+	run.Meta, err = verifier.Close(err)
+	if err == nil {
+		err = output.Close()
+	}
+	for _, writer := range writers {
+		if err != nil {
+			writer.CloseWithError(err)
+		} else {
+			writer.Close()
+		}
+	}
+	wg.Wait()
+	if err == errAllDestinationsFailed {
+		// the individual destination failures are reported in the results
+		err = nil
+	}
+	return run, err
+}
+
+// snapshotViaScratchFile downloads the snapshot to a temporary file before
+// uploading it, so that a slow destination does not hold back the others
+func (s *Snapshotter) snapshotViaScratchFile(ctx context.Context, config *config.Configuration, now int64) (*SnapshotRun, error) {
+	run := &SnapshotRun{}
+	scratch, err := ioutil.TempFile(config.ScratchPath, "raft_snapshot-*.tmp")
+	if err != nil {
+		return run, Permanent(fmt.Errorf("unable to create scratch file: %v", err))
+	}
+	defer os.Remove(scratch.Name())
+	// the snapshot is verified while it is written, so that only the encrypted
+	// snapshot ever reaches the disk if encryption is enabled
+	verifier := newSnapshotVerifier()
+	var output io.WriteCloser = nopWriteCloser{scratch}
+	if s.Encryptor.Enabled() {
+		output, err = s.Encryptor.Encrypt(ctx, output)
+	}
+	if err == nil {
+		run.Size, err = s.fetchRaftSnapshot(ctx, io.MultiWriter(verifier, output))
+	}
+	run.Meta, err = verifier.Close(err)
+	if err == nil {
+		err = output.Close()
+	}
+	if closeErr := scratch.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return run, err
+	}
+
+	run.Results = make([]SnapshotResult, len(s.Destinations))
+	var wg sync.WaitGroup
+	for i, dest := range s.Destinations {
+		wg.Add(1)
+		go func(i int, dest Destination) {
+			defer wg.Done()
+			run.Results[i] = SnapshotResult{Destination: dest.Name}
+			run.Results[i].Err = s.Retry.Do(ctx, "upload "+dest.Name+" snapshot", func() error {
+				file, err := os.Open(scratch.Name())
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				run.Results[i].Name, run.Results[i].Location, run.Results[i].Deleted, err = s.CreateSnapshot(ctx, dest, file, config, now)
+				if err != nil && run.Results[i].Location != "" {
+					// the upload succeeded and only pruning failed
+					return Permanent(err)
+				}
+				return err
+			})
+		}(i, dest)
+	}
+	wg.Wait()
+	return run, nil
+}
+
+// fanOutWriter copies every write to all of its writers.  Unlike io.MultiWriter
+// a failing writer is dropped instead of aborting the remaining ones.
+type fanOutWriter struct {
+	writers []io.Writer
+}
+
+func newFanOutWriter(writers []*io.PipeWriter) *fanOutWriter {
+	w := &fanOutWriter{writers: make([]io.Writer, len(writers))}
+	for i := range writers {
+		w.writers[i] = writers[i]
+	}
+	return w
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	active := f.writers[:0]
+	for _, w := range f.writers {
+		if _, err := w.Write(p); err == nil {
+			active = append(active, w)
+		}
+	}
+	f.writers = active
+	if len(f.writers) == 0 {
+		return 0, errAllDestinationsFailed
+	}
+	return len(p), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package snapshot_agent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SortedSnapshots lists the snapshots of the storage in the order they were taken, oldest first
+func SortedSnapshots(ctx context.Context, storage Storage) ([]SnapshotInfo, error) {
+	snapshots, err := storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sortByTime(snapshots)
+	return snapshots, nil
+}
+
+// FindSnapshot selects a snapshot of the storage.  The selector is either the
+// name of the snapshot, the unix nano timestamp in its name, "latest" or an
+// RFC3339 timestamp, which selects the newest snapshot taken at or before that time.
+func FindSnapshot(ctx context.Context, storage Storage, selector string) (SnapshotInfo, error) {
+	snapshots, err := SortedSnapshots(ctx, storage)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if len(snapshots) == 0 {
+		return SnapshotInfo{}, fmt.Errorf("no snapshots found in %s", storage.Describe())
+	}
+	if selector == "latest" {
+		return snapshots[len(snapshots)-1], nil
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == selector {
+			return snapshot, nil
+		}
+	}
+	if ts, err := strconv.ParseInt(selector, 10, 64); err == nil {
+		for _, snapshot := range snapshots {
+			if snapshot.Name == snapshotFileName(ts) {
+				return snapshot, nil
+			}
+		}
+	}
+	if until, err := time.Parse(time.RFC3339, selector); err == nil {
+		for i := len(snapshots) - 1; i >= 0; i-- {
+			if !snapshots[i].Time().After(until) {
+				return snapshots[i], nil
+			}
+		}
+		return SnapshotInfo{}, fmt.Errorf("no snapshot taken at or before %s", selector)
+	}
+	return SnapshotInfo{}, fmt.Errorf("snapshot %s not found", selector)
+}
+
+// RestoreSnapshot downloads the named snapshot from the destination and installs
+// it into Vault.  With force set, a snapshot of a different cluster is accepted.
+func (s *Snapshotter) RestoreSnapshot(ctx context.Context, dest Destination, name string, force bool) error {
+	reader, err := dest.Storage.Download(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	snapshot, err := s.Encryptor.Decrypt(ctx, reader)
+	if err != nil {
+		return err
+	}
+	return s.restoreRaftSnapshot(ctx, snapshot, force)
+}
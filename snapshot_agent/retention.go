@@ -0,0 +1,179 @@
+package snapshot_agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+)
+
+// RetentionPolicy decides which snapshots are kept.  A snapshot is kept if it is
+// one of the Last newest snapshots, or if it is the newest snapshot of one of the
+// most recent Hourly hours, Daily days, Weekly weeks, Monthly months or Yearly
+// years that have a snapshot.  Without any of those counts every snapshot is
+// selected.  Selected snapshots older than MaxAge are dropped, but the MinKeep
+// newest snapshots are always kept.  All other snapshots are deleted.
+type RetentionPolicy struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	MaxAge  time.Duration
+	MinKeep int
+}
+
+// NewRetentionPolicy builds the retention policy from the configuration, where
+// retain is the number of newest snapshots to keep
+func NewRetentionPolicy(config *config.Configuration) (RetentionPolicy, error) {
+	policy := RetentionPolicy{
+		Last:    int(config.Retain),
+		Hourly:  config.Retention.Hourly,
+		Daily:   config.Retention.Daily,
+		Weekly:  config.Retention.Weekly,
+		Monthly: config.Retention.Monthly,
+		Yearly:  config.Retention.Yearly,
+		MinKeep: config.Retention.MinKeep,
+	}
+	if config.Retention.MaxAge != "" {
+		maxAge, err := time.ParseDuration(config.Retention.MaxAge)
+		if err != nil {
+			return policy, fmt.Errorf("invalid retention max_age: %v", err)
+		}
+		policy.MaxAge = maxAge
+	}
+	return policy, nil
+}
+
+// Enabled reports whether the policy deletes anything at all
+func (p RetentionPolicy) Enabled() bool {
+	return p.counted() || p.MaxAge > 0
+}
+
+// counted reports whether any of the count based rules is set
+func (p RetentionPolicy) counted() bool {
+	return p.Last > 0 || p.Hourly > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Yearly > 0
+}
+
+// Apply splits the snapshots into the ones to keep and the ones to delete, with
+// ages relative to now.  Both are returned oldest first.
+func (p RetentionPolicy) Apply(snapshots []SnapshotInfo, now time.Time) (keep []SnapshotInfo, remove []SnapshotInfo) {
+	sorted := make([]SnapshotInfo, len(snapshots))
+	copy(sorted, snapshots)
+	sortByTime(sorted)
+
+	buckets := []*retentionBucket{
+		{count: p.Hourly, period: func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{count: p.Daily, period: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{count: p.Weekly, period: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{count: p.Monthly, period: func(t time.Time) string { return t.Format("2006-01") }},
+		{count: p.Yearly, period: func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	kept := make([]bool, len(sorted))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		newest := len(sorted) - i
+		t := sorted[i].Time()
+		kept[i] = !p.counted() || newest <= p.Last
+		for _, b := range buckets {
+			if b.keep(t.UTC()) {
+				kept[i] = true
+			}
+		}
+		if p.MaxAge > 0 && now.Sub(t) > p.MaxAge {
+			kept[i] = false
+		}
+		if newest <= p.MinKeep {
+			kept[i] = true
+		}
+	}
+	for i, snapshot := range sorted {
+		if kept[i] {
+			keep = append(keep, snapshot)
+		} else {
+			remove = append(remove, snapshot)
+		}
+	}
+	return keep, remove
+}
+
+// retentionBucket keeps the newest snapshot of each of the count most recent periods
+type retentionBucket struct {
+	count  int
+	period func(t time.Time) string
+	last   string
+	kept   int
+}
+
+// keep must be called with snapshot times from newest to oldest
+func (b *retentionBucket) keep(t time.Time) bool {
+	if b.kept >= b.count {
+		return false
+	}
+	period := b.period(t)
+	if period == b.last {
+		return false
+	}
+	b.last = period
+	b.kept++
+	return true
+}
+
+func applyRetention(ctx context.Context, dest Destination, policy RetentionPolicy) ([]SnapshotInfo, error) {
+	_, deleted, _, err := pruneStorage(ctx, dest, policy, false)
+	return deleted, err
+}
+
+// PruneResult lists the snapshots of a destination that were kept and deleted,
+// or would be deleted in a dry run
+type PruneResult struct {
+	Destination string
+	Kept        []SnapshotInfo
+	Deleted     []SnapshotInfo
+	// Undeleted lists the snapshots that were left because deleting failed
+	Undeleted []SnapshotInfo
+	Err       error
+}
+
+// Prune applies the retention policy to every destination without taking a new
+// snapshot.  If dryRun is set, nothing is deleted.
+func (s *Snapshotter) Prune(ctx context.Context, dryRun bool) []PruneResult {
+	results := make([]PruneResult, 0, len(s.Destinations))
+	for _, dest := range s.Destinations {
+		if staticName(dest.Storage) != "" {
+			continue
+		}
+		result := PruneResult{Destination: dest.Name}
+		result.Kept, result.Deleted, result.Undeleted, result.Err = pruneStorage(ctx, dest, s.Retention, dryRun)
+		results = append(results, result)
+	}
+	return results
+}
+
+// pruneStorage deletes the snapshots the policy does not keep.  On failure the
+// snapshots deleted so far are returned along with the ones left undeleted.
+func pruneStorage(ctx context.Context, dest Destination, policy RetentionPolicy, dryRun bool) ([]SnapshotInfo, []SnapshotInfo, []SnapshotInfo, error) {
+	snapshots, err := dest.Storage.List(ctx)
+	if err != nil {
+		Logger(ctx).Error("Unable to list existing snapshots to delete old snapshots", "error", err)
+		return nil, nil, nil, err
+	}
+	keep, remove := policy.Apply(snapshots, time.Now())
+	if dryRun {
+		return keep, remove, nil, nil
+	}
+	for i, snapshot := range remove {
+		if err := dest.Storage.Delete(ctx, snapshot.Name); err != nil {
+			Logger(ctx).Error("Error when deleting snapshot", "name", snapshot.Name, "error", err)
+			return keep, remove[:i], remove[i:], err
+		}
+		Logger(ctx).Info("Deleted snapshot", "name", snapshot.Name)
+		retentionDeletions.WithLabelValues(dest.Name).Inc()
+	}
+	return keep, remove, nil, nil
+}
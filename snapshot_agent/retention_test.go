@@ -0,0 +1,224 @@
+package snapshot_agent
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+)
+
+var retentionNow = time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+
+// snapshotsAt names snapshots like the agent does, in the order of times
+func snapshotsAt(t *testing.T, times ...string) []SnapshotInfo {
+	t.Helper()
+	snapshots := make([]SnapshotInfo, 0, len(times))
+	for _, value := range times {
+		ts, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, SnapshotInfo{Name: fmt.Sprintf("raft_snapshot-%d.snap", ts.UnixNano())})
+	}
+	return snapshots
+}
+
+func snapshotTimes(snapshots []SnapshotInfo) []string {
+	var times []string
+	for _, snapshot := range snapshots {
+		times = append(times, snapshot.Time().UTC().Format(time.RFC3339))
+	}
+	return times
+}
+
+func TestRetentionPolicyApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    RetentionPolicy
+		snapshots []string
+		keep      []string
+		remove    []string
+	}{
+		{
+			name:      "no rules",
+			policy:    RetentionPolicy{},
+			snapshots: []string{"2021-06-28T12:00:00Z", "2021-06-29T12:00:00Z"},
+			keep:      []string{"2021-06-28T12:00:00Z", "2021-06-29T12:00:00Z"},
+		},
+		{
+			name:      "legacy retain",
+			policy:    RetentionPolicy{Last: 2},
+			snapshots: []string{"2021-06-30T08:00:00Z", "2021-06-30T09:00:00Z", "2021-06-30T10:00:00Z", "2021-06-30T11:00:00Z"},
+			keep:      []string{"2021-06-30T10:00:00Z", "2021-06-30T11:00:00Z"},
+			remove:    []string{"2021-06-30T08:00:00Z", "2021-06-30T09:00:00Z"},
+		},
+		{
+			name:      "legacy retain with fewer snapshots",
+			policy:    RetentionPolicy{Last: 5},
+			snapshots: []string{"2021-06-30T10:00:00Z", "2021-06-30T11:00:00Z"},
+			keep:      []string{"2021-06-30T10:00:00Z", "2021-06-30T11:00:00Z"},
+		},
+		{
+			name:      "unsorted",
+			policy:    RetentionPolicy{Last: 2},
+			snapshots: []string{"2021-06-30T11:00:00Z", "2021-06-30T08:00:00Z", "2021-06-30T10:00:00Z", "2021-06-30T09:00:00Z"},
+			keep:      []string{"2021-06-30T10:00:00Z", "2021-06-30T11:00:00Z"},
+			remove:    []string{"2021-06-30T08:00:00Z", "2021-06-30T09:00:00Z"},
+		},
+		{
+			name:      "hourly",
+			policy:    RetentionPolicy{Hourly: 2},
+			snapshots: []string{"2021-06-30T09:30:00Z", "2021-06-30T10:00:00Z", "2021-06-30T10:30:00Z", "2021-06-30T11:00:00Z", "2021-06-30T11:30:00Z"},
+			keep:      []string{"2021-06-30T10:30:00Z", "2021-06-30T11:30:00Z"},
+			remove:    []string{"2021-06-30T09:30:00Z", "2021-06-30T10:00:00Z", "2021-06-30T11:00:00Z"},
+		},
+		{
+			name:      "daily",
+			policy:    RetentionPolicy{Daily: 2},
+			snapshots: []string{"2021-06-28T12:00:00Z", "2021-06-29T08:00:00Z", "2021-06-29T20:00:00Z", "2021-06-30T06:00:00Z", "2021-06-30T10:00:00Z"},
+			keep:      []string{"2021-06-29T20:00:00Z", "2021-06-30T10:00:00Z"},
+			remove:    []string{"2021-06-28T12:00:00Z", "2021-06-29T08:00:00Z", "2021-06-30T06:00:00Z"},
+		},
+		{
+			name:      "daily skips days without snapshots",
+			policy:    RetentionPolicy{Daily: 2},
+			snapshots: []string{"2021-06-20T12:00:00Z", "2021-06-25T12:00:00Z", "2021-06-25T13:00:00Z"},
+			keep:      []string{"2021-06-20T12:00:00Z", "2021-06-25T13:00:00Z"},
+			remove:    []string{"2021-06-25T12:00:00Z"},
+		},
+		{
+			// weeks are ISO weeks starting on Monday
+			name:      "weekly",
+			policy:    RetentionPolicy{Weekly: 2},
+			snapshots: []string{"2021-06-14T12:00:00Z", "2021-06-20T12:00:00Z", "2021-06-21T12:00:00Z", "2021-06-27T12:00:00Z", "2021-06-28T12:00:00Z", "2021-06-30T06:00:00Z"},
+			keep:      []string{"2021-06-27T12:00:00Z", "2021-06-30T06:00:00Z"},
+			remove:    []string{"2021-06-14T12:00:00Z", "2021-06-20T12:00:00Z", "2021-06-21T12:00:00Z", "2021-06-28T12:00:00Z"},
+		},
+		{
+			name:      "weekly across years",
+			policy:    RetentionPolicy{Weekly: 2},
+			snapshots: []string{"2020-12-27T12:00:00Z", "2020-12-28T12:00:00Z", "2021-01-03T12:00:00Z", "2021-01-04T12:00:00Z"},
+			keep:      []string{"2021-01-03T12:00:00Z", "2021-01-04T12:00:00Z"},
+			remove:    []string{"2020-12-27T12:00:00Z", "2020-12-28T12:00:00Z"},
+		},
+		{
+			name:      "monthly",
+			policy:    RetentionPolicy{Monthly: 3},
+			snapshots: []string{"2021-03-15T12:00:00Z", "2021-04-10T12:00:00Z", "2021-04-20T12:00:00Z", "2021-05-31T12:00:00Z", "2021-06-01T12:00:00Z", "2021-06-30T06:00:00Z"},
+			keep:      []string{"2021-04-20T12:00:00Z", "2021-05-31T12:00:00Z", "2021-06-30T06:00:00Z"},
+			remove:    []string{"2021-03-15T12:00:00Z", "2021-04-10T12:00:00Z", "2021-06-01T12:00:00Z"},
+		},
+		{
+			name:      "yearly",
+			policy:    RetentionPolicy{Yearly: 2},
+			snapshots: []string{"2019-12-31T12:00:00Z", "2020-01-01T12:00:00Z", "2020-12-31T12:00:00Z", "2021-06-30T06:00:00Z"},
+			keep:      []string{"2020-12-31T12:00:00Z", "2021-06-30T06:00:00Z"},
+			remove:    []string{"2019-12-31T12:00:00Z", "2020-01-01T12:00:00Z"},
+		},
+		{
+			name:      "last and daily",
+			policy:    RetentionPolicy{Last: 2, Daily: 2},
+			snapshots: []string{"2021-06-28T12:00:00Z", "2021-06-29T08:00:00Z", "2021-06-29T20:00:00Z", "2021-06-30T06:00:00Z", "2021-06-30T10:00:00Z"},
+			keep:      []string{"2021-06-29T20:00:00Z", "2021-06-30T06:00:00Z", "2021-06-30T10:00:00Z"},
+			remove:    []string{"2021-06-28T12:00:00Z", "2021-06-29T08:00:00Z"},
+		},
+		{
+			name:      "grandfather-father-son",
+			policy:    RetentionPolicy{Daily: 2, Weekly: 2, Monthly: 2},
+			snapshots: []string{"2021-04-30T12:00:00Z", "2021-05-31T12:00:00Z", "2021-06-20T12:00:00Z", "2021-06-27T12:00:00Z", "2021-06-28T12:00:00Z", "2021-06-29T12:00:00Z", "2021-06-30T06:00:00Z"},
+			keep:      []string{"2021-05-31T12:00:00Z", "2021-06-27T12:00:00Z", "2021-06-29T12:00:00Z", "2021-06-30T06:00:00Z"},
+			remove:    []string{"2021-04-30T12:00:00Z", "2021-06-20T12:00:00Z", "2021-06-28T12:00:00Z"},
+		},
+		{
+			name:      "max age",
+			policy:    RetentionPolicy{MaxAge: 48 * time.Hour},
+			snapshots: []string{"2021-06-27T12:00:00Z", "2021-06-28T13:00:00Z", "2021-06-30T06:00:00Z"},
+			keep:      []string{"2021-06-28T13:00:00Z", "2021-06-30T06:00:00Z"},
+			remove:    []string{"2021-06-27T12:00:00Z"},
+		},
+		{
+			name:      "max age limits counts",
+			policy:    RetentionPolicy{Daily: 7, MaxAge: 48 * time.Hour},
+			snapshots: []string{"2021-06-26T12:00:00Z", "2021-06-27T12:00:00Z", "2021-06-28T13:00:00Z", "2021-06-29T12:00:00Z"},
+			keep:      []string{"2021-06-28T13:00:00Z", "2021-06-29T12:00:00Z"},
+			remove:    []string{"2021-06-26T12:00:00Z", "2021-06-27T12:00:00Z"},
+		},
+		{
+			name:      "min keep overrides max age",
+			policy:    RetentionPolicy{MaxAge: 24 * time.Hour, MinKeep: 2},
+			snapshots: []string{"2021-06-20T12:00:00Z", "2021-06-21T12:00:00Z", "2021-06-22T12:00:00Z"},
+			keep:      []string{"2021-06-21T12:00:00Z", "2021-06-22T12:00:00Z"},
+			remove:    []string{"2021-06-20T12:00:00Z"},
+		},
+		{
+			name:      "min keep with fewer snapshots",
+			policy:    RetentionPolicy{MaxAge: 24 * time.Hour, MinKeep: 5},
+			snapshots: []string{"2021-06-20T12:00:00Z", "2021-06-21T12:00:00Z"},
+			keep:      []string{"2021-06-20T12:00:00Z", "2021-06-21T12:00:00Z"},
+		},
+		{
+			name:      "min keep overrides counts",
+			policy:    RetentionPolicy{Last: 1, MinKeep: 2},
+			snapshots: []string{"2021-06-30T09:00:00Z", "2021-06-30T10:00:00Z", "2021-06-30T11:00:00Z"},
+			keep:      []string{"2021-06-30T10:00:00Z", "2021-06-30T11:00:00Z"},
+			remove:    []string{"2021-06-30T09:00:00Z"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keep, remove := test.policy.Apply(snapshotsAt(t, test.snapshots...), retentionNow)
+			if got := snapshotTimes(keep); !reflect.DeepEqual(got, test.keep) {
+				t.Errorf("kept %v, want %v", got, test.keep)
+			}
+			if got := snapshotTimes(remove); !reflect.DeepEqual(got, test.remove) {
+				t.Errorf("removed %v, want %v", got, test.remove)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicyWithoutTimestamp(t *testing.T) {
+	// snapshots that were renamed are ordered by their modification time
+	snapshots := []SnapshotInfo{
+		{Name: "manual.snap", LastModified: retentionNow.Add(-time.Hour)},
+		{Name: "raft_snapshot-1624968000000000000.snap"},
+	}
+	keep, remove := RetentionPolicy{Last: 1}.Apply(snapshots, retentionNow)
+	if len(keep) != 1 || keep[0].Name != "manual.snap" {
+		t.Errorf("kept %v, want manual.snap", keep)
+	}
+	if len(remove) != 1 || remove[0].Name != "raft_snapshot-1624968000000000000.snap" {
+		t.Errorf("removed %v, want raft_snapshot-1624968000000000000.snap", remove)
+	}
+}
+
+func TestNewRetentionPolicy(t *testing.T) {
+	policy, err := NewRetentionPolicy(&config.Configuration{
+		Retain:    3,
+		Retention: config.RetentionConfig{Daily: 7, Weekly: 4, MaxAge: "720h", MinKeep: 2},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := RetentionPolicy{Last: 3, Daily: 7, Weekly: 4, MaxAge: 720 * time.Hour, MinKeep: 2}
+	if policy != want {
+		t.Errorf("got %+v, want %+v", policy, want)
+	}
+
+	legacy, err := NewRetentionPolicy(&config.Configuration{Retain: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if legacy != (RetentionPolicy{Last: 5}) || !legacy.Enabled() {
+		t.Errorf("got %+v, want only the 5 newest snapshots to be kept", legacy)
+	}
+	if (RetentionPolicy{MinKeep: 3}).Enabled() {
+		t.Error("min_keep alone must not enable pruning")
+	}
+
+	if _, err := NewRetentionPolicy(&config.Configuration{Retention: config.RetentionConfig{MaxAge: "30 days"}}); err == nil {
+		t.Error("expected an error for an invalid max_age")
+	}
+}
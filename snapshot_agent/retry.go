@@ -0,0 +1,124 @@
+package snapshot_agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+)
+
+// RetryPolicy retries failed operations with exponential backoff and jitter
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// NewRetryPolicy builds the retry policy from the configuration.  By default an
+// operation is attempted three times, waiting about 1s and then 2s in between.
+func NewRetryPolicy(config *config.Configuration) (*RetryPolicy, error) {
+	policy := &RetryPolicy{
+		MaxAttempts:     3,
+		InitialInterval: time.Second,
+		MaxInterval:     time.Minute,
+		Multiplier:      2,
+		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if config.Retry.MaxAttempts > 0 {
+		policy.MaxAttempts = config.Retry.MaxAttempts
+	}
+	if config.Retry.Multiplier >= 1 {
+		policy.Multiplier = config.Retry.Multiplier
+	}
+	var err error
+	if config.Retry.InitialInterval != "" {
+		if policy.InitialInterval, err = time.ParseDuration(config.Retry.InitialInterval); err != nil {
+			return nil, fmt.Errorf("invalid retry initial_interval: %v", err)
+		}
+	}
+	if config.Retry.MaxInterval != "" {
+		if policy.MaxInterval, err = time.ParseDuration(config.Retry.MaxInterval); err != nil {
+			return nil, fmt.Errorf("invalid retry max_interval: %v", err)
+		}
+	}
+	return policy, nil
+}
+
+// Do runs op until it succeeds or the attempts are exhausted, and returns the
+// last error.  Errors wrapped with Permanent are not retried, and the context
+// being canceled stops the retries.
+func (p *RetryPolicy) Do(ctx context.Context, description string, op func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			// the marker is only stripped if op returned it directly, so that
+			// the context added by wrapping it is kept
+			if err == permanent {
+				return permanent.err
+			}
+			return err
+		}
+		if attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		backoff := p.Backoff(attempt)
+		Logger(ctx).Warn("Attempt to "+description+" failed, retrying",
+			"attempt", attempt, "max_attempts", p.MaxAttempts, "backoff", backoff.Round(time.Millisecond).String(), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Backoff returns how long to wait after the given failed attempt, starting at
+// 1.  The exponential interval is capped at MaxInterval and randomized to
+// between half and all of it, so that agents do not retry in lockstep.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	interval := float64(p.InitialInterval)
+	for i := 1; i < attempt && interval < float64(p.MaxInterval); i++ {
+		interval *= p.Multiplier
+	}
+	if interval > float64(p.MaxInterval) {
+		interval = float64(p.MaxInterval)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Duration(interval/2 + p.random.Float64()*interval/2)
+}
+
+// permanentError marks an error that retrying cannot resolve
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps err so that RetryPolicy.Do returns it without retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
@@ -1,113 +1,284 @@
 package snapshot_agent
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"sort"
+	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/Lucretius/vault_raft_snapshot_agent/config"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-// CreateS3Snapshot writes snapshot to s3 location
-func (s *Snapshotter) CreateS3Snapshot(reader io.ReadWriter, config *config.Configuration, currentTs int64) (string, error) {
+func init() {
+	RegisterStorage("aws", newS3Storage)
+}
+
+// s3Storage writes snapshots to an S3 (or S3 compatible) bucket
+type s3Storage struct {
+	uploader           *s3manager.Uploader
+	client             *s3.S3
+	bucket             string
+	keyPrefix          string
+	sse                *s3Encryption
+	staticSnapshotName string
+}
+
+// s3Encryption holds the server side encryption settings of uploaded snapshots.
+// Objects encrypted with a customer key (SSE-C) can only be read with the key,
+// while S3 decrypts SSE-S3 and SSE-KMS objects transparently.
+type s3Encryption struct {
+	algorithm        string
+	kmsKeyID         string
+	kmsContext       string
+	bucketKeyEnabled bool
+	customerKey      string
+}
+
+func newS3Encryption(c config.S3Config) (*s3Encryption, error) {
+	e := &s3Encryption{}
+	customerKey, err := readS3CustomerKey(c.SSECustomerKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if customerKey != "" && (c.SSE || c.SSEKMSKeyID != "") {
+		return nil, errors.New("s3_sse_customer_key_file cannot be combined with other server side encryption")
+	}
+	if c.SSEKMSKeyID == "" && (len(c.SSEKMSEncryptionContext) > 0 || c.SSEBucketKeyEnabled) {
+		return nil, errors.New("s3_sse_kms_encryption_context and s3_sse_bucket_key_enabled require s3_sse_kms_key_id")
+	}
+	switch {
+	case customerKey != "":
+		e.customerKey = customerKey
+	case c.SSEKMSKeyID != "":
+		e.algorithm = s3.ServerSideEncryptionAwsKms
+		e.kmsKeyID = c.SSEKMSKeyID
+		e.bucketKeyEnabled = c.SSEBucketKeyEnabled
+		if len(c.SSEKMSEncryptionContext) > 0 {
+			encoded, err := json.Marshal(c.SSEKMSEncryptionContext)
+			if err != nil {
+				return nil, err
+			}
+			e.kmsContext = base64.StdEncoding.EncodeToString(encoded)
+		}
+	case c.SSE:
+		e.algorithm = s3.ServerSideEncryptionAes256
+	}
+	return e, nil
+}
+
+// readS3CustomerKey reads the SSE-C key from file, or from the
+// AWS_S3_SSE_CUSTOMER_KEY environment variable
+func readS3CustomerKey(file string) (string, error) {
+	encoded := os.Getenv("AWS_S3_SSE_CUSTOMER_KEY")
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("unable to read S3 customer key: %v", err)
+		}
+		encoded = string(content)
+	}
+	if encoded == "" {
+		return "", nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return "", errors.New("S3 customer key must be 32 bytes encoded in base64")
+	}
+	return string(key), nil
+}
+
+func (e *s3Encryption) applyUpload(input *s3manager.UploadInput) {
+	if e.algorithm != "" {
+		input.ServerSideEncryption = aws.String(e.algorithm)
+	}
+	if e.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(e.kmsKeyID)
+	}
+	if e.kmsContext != "" {
+		input.SSEKMSEncryptionContext = aws.String(e.kmsContext)
+	}
+	if e.bucketKeyEnabled {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+	if e.customerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(e.customerKey)
+	}
+}
+
+// applyDownload sets the customer key needed to read SSE-C objects
+func (e *s3Encryption) applyDownload(input *s3.GetObjectInput) {
+	if e.customerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(e.customerKey)
+	}
+}
+
+func newS3Storage(config *config.Configuration) (Storage, error) {
+	if config.AWS.Bucket == "" {
+		return nil, nil
+	}
+	awsConfig := &aws.Config{Region: aws.String(config.AWS.Region)}
+
+	if config.AWS.AccessKeyID != "" && config.AWS.SecretAccessKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(config.AWS.AccessKeyID, config.AWS.SecretAccessKey, "")
+	}
+
+	if config.AWS.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.AWS.Endpoint)
+	}
+
+	if config.AWS.S3ForcePathStyle != false {
+		awsConfig.S3ForcePathStyle = aws.Bool(config.AWS.S3ForcePathStyle)
+	}
+
 	keyPrefix := "raft_snapshots"
 	if config.AWS.KeyPrefix != "" {
 		keyPrefix = config.AWS.KeyPrefix
 	}
 
-	input := &s3manager.UploadInput{
-		Bucket:               &config.AWS.Bucket,
-		Key:                  aws.String(fmt.Sprintf("%s/raft_snapshot-%d.snap", keyPrefix, currentTs)),
-		Body:                 reader,
-		ServerSideEncryption: nil,
+	sse, err := newS3Encryption(config.AWS)
+	if err != nil {
+		return nil, err
 	}
 
-	if config.AWS.SSE == true {
-		input.ServerSideEncryption = aws.String("AES256")
-	}
+	sess := session.Must(session.NewSession(awsConfig))
+	return &s3Storage{
+		uploader:           s3manager.NewUploader(sess),
+		client:             s3.New(sess),
+		bucket:             config.AWS.Bucket,
+		keyPrefix:          keyPrefix,
+		sse:                sse,
+		staticSnapshotName: config.AWS.StaticSnapshotName,
+	}, nil
+}
 
-	if config.AWS.StaticSnapshotName != "" {
-		input.Key = aws.String(fmt.Sprintf("%s/%s.snap", keyPrefix, config.AWS.StaticSnapshotName))
+// Upload writes snapshot to s3 location.  A failed or canceled multipart upload
+// is aborted, so that no parts are left behind.
+func (s *s3Storage) Upload(ctx context.Context, reader io.Reader, fileName string) (string, error) {
+	input := &s3manager.UploadInput{
+		Bucket: &s.bucket,
+		Key:    aws.String(s.key(fileName)),
+		Body:   reader,
 	}
+	s.sse.applyUpload(input)
 
-	o, err := s.Uploader.Upload(input)
+	// the uploader would abort with the upload context, which is already
+	// canceled if the agent is shutting down
+	o, err := s.uploader.UploadWithContext(ctx, input, func(u *s3manager.Uploader) {
+		u.LeavePartsOnError = true
+	})
 	if err != nil {
+		var failure s3manager.MultiUploadFailure
+		if errors.As(err, &failure) {
+			s.abortUpload(ctx, input.Key, failure.UploadID())
+		}
 		return "", err
-	} else {
-		if config.Retain > 0 && config.AWS.StaticSnapshotName == "" {
-			existingSnapshotList, err := s.S3Client.ListObjects(&s3.ListObjectsInput{
-				Bucket: &config.AWS.Bucket,
-				Prefix: aws.String(keyPrefix),
-			})
-			if err != nil {
-				log.Println("Error when retrieving existing snapshots for delete action.")
-				return o.Location, err
-			}
-			existingSnapshots := make([]s3.Object, 0)
-
-			for _, obj := range existingSnapshotList.Contents {
-				if strings.HasSuffix(*obj.Key, ".snap") && strings.Contains(*obj.Key, "raft_snapshot-") {
-					existingSnapshots = append(existingSnapshots, *obj)
-				}
-			}
+	}
+	return o.Location, nil
+}
 
-			if len(existingSnapshots) <= int(config.Retain) {
-				return o.Location, nil
-			}
+// abortUpload removes the parts uploaded by a failed multipart upload
+func (s *s3Storage) abortUpload(uploadCtx context.Context, key *string, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      key,
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		Logger(uploadCtx).Error("Unable to abort failed multipart upload", "key", *key, "upload_id", uploadID, "error", err)
+	}
+}
 
-			timestamp := func(o1, o2 *s3.Object) bool {
-				return o1.LastModified.Before(*o2.LastModified)
-			}
-			S3By(timestamp).Sort(existingSnapshots)
-			if len(existingSnapshots)-int(config.Retain) <= 0 {
-				return o.Location, nil
-			}
-			snapshotsToDelete := existingSnapshots[0 : len(existingSnapshots)-int(config.Retain)]
-
-			for i := range snapshotsToDelete {
-				_, err := s.S3Client.DeleteObject(&s3.DeleteObjectInput{
-					Bucket: &config.AWS.Bucket,
-					Key:    snapshotsToDelete[i].Key,
-				})
-				if err != nil {
-					log.Printf("Error when deleting snapshot %s\n.", *snapshotsToDelete[i].Key)
-					return o.Location, err
-				}
+func (s *s3Storage) List(ctx context.Context) ([]SnapshotInfo, error) {
+	prefix := s.keyPrefix + "/"
+	snapshots := make([]SnapshotInfo, 0)
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(*obj.Key, prefix)
+			if isSnapshotName(name) {
+				snapshots = append(snapshots, SnapshotInfo{Name: name, LastModified: *obj.LastModified})
 			}
 		}
-		return o.Location, nil
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
+	return snapshots, nil
 }
 
-// implementation of Sort interface for s3 objects
-type S3By func(f1, f2 *s3.Object) bool
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    aws.String(s.key(name)),
+	})
+	return err
+}
 
-func (by S3By) Sort(objects []s3.Object) {
-	fs := &s3ObjectSorter{
-		objects: objects,
-		by:      by, // The Sort method's receiver is the function (closure) that defines the sort order.
+func (s *s3Storage) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    aws.String(s.key(name)),
+	}
+	s.sse.applyDownload(input)
+	o, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, err
 	}
-	sort.Sort(fs)
+	return o.Body, nil
+}
+
+func (s *s3Storage) Check(ctx context.Context) error {
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: &s.bucket})
+	return err
 }
 
-type s3ObjectSorter struct {
-	objects []s3.Object
-	by      func(f1, f2 *s3.Object) bool // Closure used in the Less method.
+// SetBufferLimit sizes the parts and upload concurrency so that the part buffers,
+// of which the uploader keeps one more than its concurrency, fit into limit
+func (s *s3Storage) SetBufferLimit(limit int64) error {
+	partSize := s3manager.MinUploadPartSize
+	concurrency := int(limit/partSize) - 1
+	if concurrency < 1 {
+		return fmt.Errorf("need at least %d bytes", 2*partSize)
+	}
+	if concurrency > s3manager.DefaultUploadConcurrency {
+		concurrency = s3manager.DefaultUploadConcurrency
+		partSize = limit / int64(concurrency+1)
+	}
+	s.uploader.PartSize = partSize
+	s.uploader.Concurrency = concurrency
+	return nil
 }
 
-func (s *s3ObjectSorter) Len() int {
-	return len(s.objects)
+func (s *s3Storage) Describe() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.keyPrefix)
 }
 
-func (s *s3ObjectSorter) Less(i, j int) bool {
-	return s.by(&s.objects[i], &s.objects[j])
+// StaticName returns the name of the static key that every upload overwrites
+func (s *s3Storage) StaticName() string {
+	if s.staticSnapshotName == "" {
+		return ""
+	}
+	return s.staticSnapshotName + ".snap"
 }
 
-func (s *s3ObjectSorter) Swap(i, j int) {
-	s.objects[i], s.objects[j] = s.objects[j], s.objects[i]
+func (s *s3Storage) key(fileName string) string {
+	return fmt.Sprintf("%s/%s", s.keyPrefix, fileName)
 }
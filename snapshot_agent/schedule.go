@@ -0,0 +1,80 @@
+package snapshot_agent
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule determines when snapshots are taken
+type Schedule interface {
+	// Next returns the time of the next snapshot after t
+	Next(t time.Time) time.Time
+}
+
+// NewSchedule builds the snapshot schedule from the configuration.  A cron
+// schedule takes precedence over the frequency, which defaults to one hour.
+func NewSchedule(config *config.Configuration) (Schedule, error) {
+	var schedule Schedule
+	if config.Schedule != "" {
+		cronSchedule, err := cron.ParseStandard(config.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", config.Schedule, err)
+		}
+		schedule = cronSchedule
+	} else {
+		frequency, err := time.ParseDuration(config.Frequency)
+		if err != nil {
+			frequency = time.Hour
+		}
+		schedule = &intervalSchedule{interval: frequency, align: config.AlignFrequency}
+	}
+	if config.Jitter != "" {
+		jitter, err := time.ParseDuration(config.Jitter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jitter: %v", err)
+		}
+		if jitter > 0 {
+			schedule = &jitterSchedule{
+				schedule: schedule,
+				jitter:   jitter,
+				random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+			}
+		}
+	}
+	return schedule, nil
+}
+
+// intervalSchedule runs at a fixed interval.  If aligned, runs land on multiples
+// of the interval since the start of the day (or since the unix epoch for
+// intervals longer than a day), e.g. at the top of every hour for "1h".
+type intervalSchedule struct {
+	interval time.Duration
+	align    bool
+}
+
+func (s *intervalSchedule) Next(t time.Time) time.Time {
+	if !s.align {
+		return t.Add(s.interval)
+	}
+	origin := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if s.interval > 24*time.Hour {
+		origin = time.Unix(0, 0)
+	}
+	return origin.Add(t.Sub(origin).Truncate(s.interval) + s.interval)
+}
+
+// jitterSchedule delays every run of the underlying schedule by a random
+// duration of up to jitter, so that clusters on the same schedule spread out
+type jitterSchedule struct {
+	schedule Schedule
+	jitter   time.Duration
+	random   *rand.Rand
+}
+
+func (s *jitterSchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t).Add(time.Duration(s.random.Int63n(int64(s.jitter))))
+}
@@ -0,0 +1,221 @@
+package snapshot_agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+)
+
+// Storage is a destination that snapshots are written to and read back from
+//
+// Canceling the context of an upload aborts it without leaving a partial
+// snapshot or incomplete multipart and block uploads behind.
+type Storage interface {
+	// Upload writes the snapshot read from reader under the given file name
+	// and returns the location it was written to
+	Upload(ctx context.Context, reader io.Reader, fileName string) (string, error)
+	// List returns the snapshots currently held by the storage
+	List(ctx context.Context) ([]SnapshotInfo, error)
+	// Delete removes the snapshot with the given name
+	Delete(ctx context.Context, name string) error
+	// Download opens the snapshot with the given name for reading
+	Download(ctx context.Context, name string) (io.ReadCloser, error)
+	// Check verifies that the storage is reachable with the configured credentials
+	Check(ctx context.Context) error
+	// Describe returns a human readable description of the storage location
+	Describe() string
+}
+
+// SnapshotInfo describes a snapshot held by a storage
+type SnapshotInfo struct {
+	Name         string
+	LastModified time.Time
+}
+
+// Time returns when the snapshot was taken according to the timestamp in its
+// name.  The modification time, which changes whenever the object is copied or
+// re-uploaded, is only used for names without a timestamp.
+func (s SnapshotInfo) Time() time.Time {
+	if match := snapshotNamePattern.FindStringSubmatch(s.Name); match != nil {
+		if ts, err := strconv.ParseInt(match[1], 10, 64); err == nil {
+			return time.Unix(0, ts)
+		}
+	}
+	return s.LastModified
+}
+
+// StorageFactory builds a Storage from the configuration.  It returns a nil
+// Storage if the backend is not configured.
+type StorageFactory func(config *config.Configuration) (Storage, error)
+
+// Destination is a configured storage together with its registered type name
+type Destination struct {
+	Name    string
+	Storage Storage
+}
+
+type registeredStorage struct {
+	name    string
+	factory StorageFactory
+}
+
+var storageRegistry []registeredStorage
+
+// RegisterStorage makes a storage backend available under the given type name.
+// It is meant to be called from the init function of the backend.
+func RegisterStorage(name string, factory StorageFactory) {
+	for _, r := range storageRegistry {
+		if r.name == name {
+			panic("snapshot_agent: storage registered twice: " + name)
+		}
+	}
+	storageRegistry = append(storageRegistry, registeredStorage{name: name, factory: factory})
+}
+
+// ConfigureDestinations instantiates every registered storage that is configured
+func ConfigureDestinations(config *config.Configuration) ([]Destination, error) {
+	destinations := make([]Destination, 0)
+	for _, r := range storageRegistry {
+		storage, err := r.factory(config)
+		if err != nil {
+			return nil, err
+		}
+		if storage != nil {
+			destinations = append(destinations, Destination{Name: r.name, Storage: storage})
+		}
+	}
+	return destinations, nil
+}
+
+// bufferedStorage is implemented by storages that hold parts of the snapshot
+// in memory while uploading.  SetBufferLimit caps that memory to limit bytes and
+// fails if the backend cannot operate within it.
+type bufferedStorage interface {
+	SetBufferLimit(limit int64) error
+}
+
+// limitDestinationBuffers splits the memory limit evenly across all destinations
+func limitDestinationBuffers(destinations []Destination, limitMB int64) error {
+	if limitMB <= 0 || len(destinations) == 0 {
+		return nil
+	}
+	limit := limitMB * 1024 * 1024 / int64(len(destinations))
+	for _, dest := range destinations {
+		if buffered, ok := dest.Storage.(bufferedStorage); ok {
+			if err := buffered.SetBufferLimit(limit); err != nil {
+				return fmt.Errorf("memory_limit_mb is too small for %s storage: %v", dest.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// staticStorage is implemented by storages that can overwrite the same object
+// on every upload, for which retention does not apply
+type staticStorage interface {
+	// StaticName returns the name every snapshot is written to, or an empty
+	// string if snapshots are written under their own names
+	StaticName() string
+}
+
+// staticName returns the name of the object that storage overwrites on every
+// upload, if any
+func staticName(storage Storage) string {
+	if static, ok := storage.(staticStorage); ok {
+		return static.StaticName()
+	}
+	return ""
+}
+
+// CreateSnapshot uploads the snapshot to the destination and deletes old
+// snapshots according to the configured retention policy.  It returns the name
+// and location of the snapshot and the deleted snapshots.
+func (s *Snapshotter) CreateSnapshot(ctx context.Context, dest Destination, reader io.Reader, config *config.Configuration, currentTs int64) (string, string, []SnapshotInfo, error) {
+	ctx = WithLogFields(ctx, "destination", dest.Name)
+	name := snapshotFileName(currentTs)
+	static := staticName(dest.Storage)
+	if static != "" {
+		name = static
+	}
+	start := time.Now()
+	counter := &countingReader{reader: reader}
+	location, err := dest.Storage.Upload(ctx, counter, name)
+	if err != nil {
+		return "", "", nil, err
+	}
+	duration := time.Since(start)
+	uploadDuration.WithLabelValues(dest.Name).Observe(duration.Seconds())
+	Logger(ctx).Info("Uploaded snapshot", "name", name, "location", location, "bytes", counter.n, "duration_seconds", duration.Seconds())
+	if s.Retention.Enabled() && static == "" {
+		deleted, err := applyRetention(ctx, dest, s.Retention)
+		return name, location, deleted, err
+	}
+	return name, location, nil, nil
+}
+
+// snapshotNamePattern matches the names of snapshots written by the agent
+var snapshotNamePattern = regexp.MustCompile(`^raft_snapshot-([0-9]+)\.snap$`)
+
+func snapshotFileName(currentTs int64) string {
+	return fmt.Sprintf("raft_snapshot-%d.snap", currentTs)
+}
+
+// isSnapshotName reports whether name is a snapshot written by the agent.  Only
+// those are listed, and therefore ever considered for deletion.
+func isSnapshotName(name string) bool {
+	return snapshotNamePattern.MatchString(name)
+}
+
+// sortByTime sorts the snapshots by the time they were taken, oldest first
+func sortByTime(snapshots []SnapshotInfo) {
+	timestamp := func(s1, s2 *SnapshotInfo) bool {
+		return s1.Time().Before(s2.Time())
+	}
+	SnapshotBy(timestamp).Sort(snapshots)
+}
+
+// implementation of Sort interface for snapshots
+type SnapshotBy func(s1, s2 *SnapshotInfo) bool
+
+func (by SnapshotBy) Sort(snapshots []SnapshotInfo) {
+	ss := &snapshotSorter{
+		snapshots: snapshots,
+		by:        by, // The Sort method's receiver is the function (closure) that defines the sort order.
+	}
+	sort.Sort(ss)
+}
+
+type snapshotSorter struct {
+	snapshots []SnapshotInfo
+	by        func(s1, s2 *SnapshotInfo) bool // Closure used in the Less method.
+}
+
+func (s *snapshotSorter) Len() int {
+	return len(s.snapshots)
+}
+
+func (s *snapshotSorter) Less(i, j int) bool {
+	return s.by(&s.snapshots[i], &s.snapshots[j])
+}
+
+func (s *snapshotSorter) Swap(i, j int) {
+	s.snapshots[i], s.snapshots[j] = s.snapshots[j], s.snapshots[i]
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
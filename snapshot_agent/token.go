@@ -0,0 +1,148 @@
+package snapshot_agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// reloginInterval is the time between login attempts after the retries of the
+// retry policy are exhausted
+const reloginInterval = time.Minute
+
+// setToken switches the client to the token of a successful login
+func (s *Snapshotter) setToken(secret *vaultApi.Secret) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	s.API.SetToken(secret.Auth.ClientToken)
+	s.tokenSecret = secret
+	s.tokenErr = nil
+}
+
+func (s *Snapshotter) setTokenErr(err error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	s.tokenErr = err
+}
+
+// TokenErr returns the error of the last failed attempt to log in to Vault
+// again, or nil while the agent holds a valid token
+func (s *Snapshotter) TokenErr() error {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	return s.tokenErr
+}
+
+func (s *Snapshotter) currentToken() *vaultApi.Secret {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	return s.tokenSecret
+}
+
+// ManageToken keeps the client token valid until ctx is canceled.  The token is
+// renewed while it is renewable, and the agent logs in again once the token
+// reaches its maximum TTL or cannot be renewed.  Failed logins are reported by
+// TokenErr and retried until they succeed.
+func (s *Snapshotter) ManageToken(ctx context.Context, config *config.Configuration) {
+	for {
+		if !s.watchToken(ctx, s.currentToken()) {
+			return
+		}
+		for {
+			err := s.Retry.Do(ctx, "log in to Vault", func() error {
+				return s.Login(ctx, config)
+			})
+			if err == nil {
+				Logger(ctx).Info("Logged in to Vault again")
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			s.setTokenErr(err)
+			Logger(ctx).Error("Unable to log in to Vault", "error", err, "retry_in", reloginInterval.String())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(reloginInterval):
+			}
+		}
+	}
+}
+
+// watchToken renews the token until it has to be replaced, which it reports by
+// returning true.  It returns false if ctx was canceled.
+func (s *Snapshotter) watchToken(ctx context.Context, secret *vaultApi.Secret) bool {
+	obtained := time.Now()
+	if !secret.Auth.Renewable {
+		return s.waitForExpiry(ctx, secret, obtained)
+	}
+
+	renewer, err := s.API.NewRenewer(&vaultApi.RenewerInput{Secret: secret})
+	if err != nil {
+		Logger(ctx).Error("Unable to renew Vault token", "error", err)
+		return s.waitForExpiry(ctx, secret, obtained)
+	}
+	go renewer.Renew()
+	defer renewer.Stop()
+	renewed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case renewal := <-renewer.RenewCh():
+			renewed = true
+			tokenRenewals.Inc()
+			if renewal.Secret != nil && renewal.Secret.Auth != nil {
+				Logger(ctx).Debug("Renewed Vault token", "ttl_seconds", renewal.Secret.Auth.LeaseDuration)
+			}
+		case err := <-renewer.DoneCh():
+			switch {
+			case err == nil:
+				Logger(ctx).Info("Vault token reached its maximum TTL, logging in again")
+			case renewed:
+				Logger(ctx).Warn("Unable to renew Vault token, logging in again", "error", err)
+			default:
+				// a new token that cannot be renewed, e.g. because the policy
+				// does not allow it, is used until shortly before it expires
+				// instead of logging in again right away
+				Logger(ctx).Warn("Unable to renew Vault token", "error", err)
+				return s.waitForExpiry(ctx, secret, obtained)
+			}
+			return true
+		}
+	}
+}
+
+// waitForExpiry waits until the token that was obtained at the given time is
+// about to expire, leaving the same margin as the renewer
+func (s *Snapshotter) waitForExpiry(ctx context.Context, secret *vaultApi.Secret, obtained time.Time) bool {
+	ttl := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	if ttl == 0 {
+		// the token never expires
+		<-ctx.Done()
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Until(obtained.Add(ttl * 2 / 3))):
+		Logger(ctx).Info("Vault token is about to expire, logging in again")
+		return true
+	}
+}
+
+// RevokeToken revokes the client token, so that it cannot be used after the
+// agent exits
+func (s *Snapshotter) RevokeToken(ctx context.Context) error {
+	if s.currentToken() == nil {
+		return nil
+	}
+	resp, err := s.API.RawRequestWithContext(ctx, s.API.NewRequest("PUT", "/v1/auth/token/revoke-self"))
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return err
+}
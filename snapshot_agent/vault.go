@@ -0,0 +1,98 @@
+package snapshot_agent
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// Leader looks up the current leader of the Vault cluster
+func (s *Snapshotter) Leader(ctx context.Context) (*vaultApi.LeaderResponse, error) {
+	resp, err := s.API.RawRequestWithContext(ctx, s.API.NewRequest("GET", "/v1/sys/leader"))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result vaultApi.LeaderResponse
+	if err := resp.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	if result.IsSelf {
+		isLeader.Set(1)
+	} else {
+		isLeader.Set(0)
+	}
+	return &result, nil
+}
+
+// CheckToken verifies that the current Vault token is valid
+func (s *Snapshotter) CheckToken(ctx context.Context) error {
+	if err := s.TokenErr(); err != nil {
+		return err
+	}
+	resp, err := s.API.RawRequestWithContext(ctx, s.API.NewRequest("GET", "/v1/auth/token/lookup-self"))
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// fetchRaftSnapshot streams a raft snapshot from Vault into w and returns its
+// size.  Unlike Sys().RaftSnapshot it can be canceled, and a failed request is
+// reported instead of resulting in an empty snapshot.
+func (s *Snapshotter) fetchRaftSnapshot(ctx context.Context, w io.Writer) (int64, error) {
+	start := time.Now()
+	resp, err := s.streamRequest(ctx, s.API.NewRequest("GET", "/v1/sys/storage/raft/snapshot"), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	size, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return size, err
+	}
+	fetchDuration.Observe(time.Since(start).Seconds())
+	snapshotSize.Set(float64(size))
+	return size, nil
+}
+
+// restoreRaftSnapshot installs the snapshot read from reader into Vault
+func (s *Snapshotter) restoreRaftSnapshot(ctx context.Context, reader io.Reader, force bool) error {
+	path := "/v1/sys/storage/raft/snapshot"
+	if force {
+		path = "/v1/sys/storage/raft/snapshot-force"
+	}
+	resp, err := s.streamRequest(ctx, s.API.NewRequest("POST", path), reader)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// streamRequest sends the request with the given body without the retries and
+// timeout of the Vault client, which would buffer the whole body in memory and
+// abort snapshots that take longer than a minute to transfer
+func (s *Snapshotter) streamRequest(ctx context.Context, r *vaultApi.Request, body io.Reader) (*vaultApi.Response, error) {
+	req, err := r.ToHTTP()
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(body)
+	}
+	httpResp, err := s.streamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	resp := &vaultApi.Response{Response: httpResp}
+	if err := resp.Error(); err != nil {
+		httpResp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
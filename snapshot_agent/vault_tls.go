@@ -0,0 +1,163 @@
+package snapshot_agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+// tlsReloadInterval limits how often the certificate files are checked for
+// changes, so that requests do not stat them every time
+const tlsReloadInterval = 5 * time.Second
+
+// vaultTLSConfig returns the TLS configuration of the Vault client.  Options
+// missing from the configuration file are taken from the environment variables
+// of the Vault CLI.
+func vaultTLSConfig(config *config.Configuration) (*vaultApi.TLSConfig, error) {
+	t := &vaultApi.TLSConfig{
+		CACert:        firstNonEmpty(config.CACert, os.Getenv(vaultApi.EnvVaultCACert)),
+		CAPath:        firstNonEmpty(config.CAPath, os.Getenv(vaultApi.EnvVaultCAPath)),
+		ClientCert:    firstNonEmpty(config.ClientCert, os.Getenv(vaultApi.EnvVaultClientCert)),
+		ClientKey:     firstNonEmpty(config.ClientKey, os.Getenv(vaultApi.EnvVaultClientKey)),
+		TLSServerName: firstNonEmpty(config.TLSServerName, os.Getenv(vaultApi.EnvVaultTLSServerName)),
+		Insecure:      config.TLSSkipVerify,
+	}
+	if v := os.Getenv(vaultApi.EnvVaultSkipVerify); v != "" && !t.Insecure {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", vaultApi.EnvVaultSkipVerify, v)
+		}
+		t.Insecure = insecure
+	}
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return nil, fmt.Errorf("client_cert and client_key must be set together")
+	}
+	return t, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// tlsReloader is the transport of the Vault client if certificates are read
+// from files.  It rebuilds the underlying transport whenever one of the files
+// changes, so that renewed certificates are picked up without a restart.
+type tlsReloader struct {
+	tls *vaultApi.TLSConfig
+
+	mu          sync.Mutex
+	transport   *http.Transport
+	fingerprint string
+	checkedAt   time.Time
+}
+
+func newTLSReloader(t *vaultApi.TLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{tls: t}
+	fingerprint, err := r.files()
+	if err != nil {
+		return nil, err
+	}
+	r.transport, err = newVaultTransport(t)
+	if err != nil {
+		return nil, err
+	}
+	r.fingerprint = fingerprint
+	r.checkedAt = time.Now()
+	return r, nil
+}
+
+// hasTLSFiles reports whether t reads any certificates from files
+func hasTLSFiles(t *vaultApi.TLSConfig) bool {
+	return t.CACert != "" || t.CAPath != "" || t.ClientCert != ""
+}
+
+// newVaultTransport creates a transport with the defaults of the Vault client
+// and the given TLS configuration
+func newVaultTransport(t *vaultApi.TLSConfig) (*http.Transport, error) {
+	vaultConfig := vaultApi.DefaultConfig()
+	if vaultConfig.Error != nil {
+		return nil, vaultConfig.Error
+	}
+	if err := vaultConfig.ConfigureTLS(t); err != nil {
+		return nil, fmt.Errorf("unable to configure TLS: %v", err)
+	}
+	return vaultConfig.HttpClient.Transport.(*http.Transport), nil
+}
+
+// files returns the names, sizes and modification times of the certificate
+// files, which change whenever one of them is replaced
+func (r *tlsReloader) files() (string, error) {
+	var fingerprint string
+	add := func(file string) error {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		fingerprint += fmt.Sprintf("%s:%d:%d\n", file, info.Size(), info.ModTime().UnixNano())
+		return nil
+	}
+	for _, file := range []string{r.tls.CACert, r.tls.ClientCert, r.tls.ClientKey} {
+		if file != "" {
+			if err := add(file); err != nil {
+				return "", err
+			}
+		}
+	}
+	if r.tls.CAPath != "" {
+		infos, err := ioutil.ReadDir(r.tls.CAPath)
+		if err != nil {
+			return "", err
+		}
+		for _, info := range infos {
+			if !info.IsDir() {
+				if err := add(filepath.Join(r.tls.CAPath, info.Name())); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	return fingerprint, nil
+}
+
+// current returns the transport for the certificates on disk, which are checked
+// at most once per tlsReloadInterval.  If they cannot be loaded, e.g. while they
+// are being replaced, the previous transport is kept.
+func (r *tlsReloader) current(req *http.Request) *http.Transport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) < tlsReloadInterval {
+		return r.transport
+	}
+	r.checkedAt = time.Now()
+	fingerprint, err := r.files()
+	if err != nil || fingerprint == r.fingerprint {
+		return r.transport
+	}
+	transport, err := newVaultTransport(r.tls)
+	if err != nil {
+		Logger(req.Context()).Error("Unable to reload Vault TLS certificates", "error", err)
+		return r.transport
+	}
+	Logger(req.Context()).Info("Reloaded Vault TLS certificates")
+	r.transport.CloseIdleConnections()
+	r.transport = transport
+	r.fingerprint = fingerprint
+	return transport
+}
+
+func (r *tlsReloader) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r.current(req).RoundTrip(req)
+}
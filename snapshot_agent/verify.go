@@ -0,0 +1,161 @@
+package snapshot_agent
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+// A Vault raft snapshot is a gzipped tar archive holding these files.  Vault
+// also seals the checksums with its barrier key, which cannot be checked here.
+const (
+	snapshotMetaFile       = "meta.json"
+	snapshotStateFile      = "state.bin"
+	snapshotSumsFile       = "SHA256SUMS"
+	snapshotSealedSumsFile = "SHA256SUMS.sealed"
+)
+
+// snapshotVerifier parses a raft snapshot archive while it is being written to
+// it, checks the SHA256SUMS of its files and validates the raft metadata
+type snapshotVerifier struct {
+	writer *io.PipeWriter
+	done   chan struct{}
+	meta   *raft.SnapshotMeta
+	err    error
+}
+
+func newSnapshotVerifier() *snapshotVerifier {
+	reader, writer := io.Pipe()
+	v := &snapshotVerifier{writer: writer, done: make(chan struct{})}
+	go func() {
+		defer close(v.done)
+		v.meta, v.err = verifySnapshotArchive(reader)
+		// keep consuming so that the snapshot stream is never held up by a broken archive
+		io.Copy(ioutil.Discard, reader)
+		reader.Close()
+	}()
+	return v
+}
+
+func (v *snapshotVerifier) Write(p []byte) (int, error) {
+	return v.writer.Write(p)
+}
+
+// Close signals the end of the snapshot, or its failure if err is set, and
+// waits for the verification to finish
+func (v *snapshotVerifier) Close(err error) (*raft.SnapshotMeta, error) {
+	v.writer.CloseWithError(err)
+	<-v.done
+	if err != nil {
+		return nil, err
+	}
+	return v.meta, v.err
+}
+
+// VerifySnapshot checks the integrity of the raft snapshot read from reader and
+// returns its metadata
+func VerifySnapshot(reader io.Reader) (*raft.SnapshotMeta, error) {
+	v := newSnapshotVerifier()
+	_, err := io.Copy(v, reader)
+	return v.Close(err)
+}
+
+func verifySnapshotArchive(reader io.Reader) (*raft.SnapshotMeta, error) {
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot is not a gzip archive: %v", err)
+	}
+	archive := tar.NewReader(gz)
+
+	hashes := map[string]hash.Hash{
+		snapshotMetaFile:  sha256.New(),
+		snapshotStateFile: sha256.New(),
+	}
+	var metaJSON bytes.Buffer
+	var sums []byte
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read snapshot archive: %v", err)
+		}
+		switch header.Name {
+		case snapshotMetaFile:
+			_, err = io.Copy(io.MultiWriter(hashes[snapshotMetaFile], &metaJSON), archive)
+		case snapshotStateFile:
+			_, err = io.Copy(hashes[snapshotStateFile], archive)
+		case snapshotSumsFile:
+			sums, err = ioutil.ReadAll(archive)
+		case snapshotSealedSumsFile:
+			_, err = io.Copy(ioutil.Discard, archive)
+		default:
+			return nil, fmt.Errorf("unexpected file %s in snapshot archive", header.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s from snapshot archive: %v", header.Name, err)
+		}
+	}
+	// read up to the gzip trailer so that its checksum is verified as well
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return nil, fmt.Errorf("snapshot archive is corrupt: %v", err)
+	}
+
+	if sums == nil {
+		return nil, fmt.Errorf("snapshot archive is missing %s", snapshotSumsFile)
+	}
+	expected, err := parseSHA256Sums(sums)
+	if err != nil {
+		return nil, err
+	}
+	for name, h := range hashes {
+		sum, ok := expected[name]
+		if !ok {
+			return nil, fmt.Errorf("%s has no checksum for %s", snapshotSumsFile, name)
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != sum {
+			return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, sum, actual)
+		}
+	}
+
+	meta := &raft.SnapshotMeta{}
+	if err := json.Unmarshal(metaJSON.Bytes(), meta); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", snapshotMetaFile, err)
+	}
+	if meta.Version < raft.SnapshotVersionMin || meta.Version > raft.SnapshotVersionMax {
+		return nil, fmt.Errorf("unsupported snapshot version %d", meta.Version)
+	}
+	if meta.Index == 0 || meta.Term == 0 {
+		return nil, fmt.Errorf("invalid snapshot metadata: index %d, term %d", meta.Index, meta.Term)
+	}
+	return meta, nil
+}
+
+// parseSHA256Sums parses the output of sha256sum into a map of file name to hex digest
+func parseSHA256Sums(sums []byte) (map[string]string, error) {
+	expected := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed line in %s: %q", snapshotSumsFile, scanner.Text())
+		}
+		expected[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return expected, scanner.Err()
+}
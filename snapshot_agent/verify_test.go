@@ -0,0 +1,94 @@
+package snapshot_agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type archiveFile struct {
+	name    string
+	content []byte
+}
+
+// vaultSnapshot builds an archive laid out like the snapshots of Vault, whose
+// checksums are sealed with the barrier key in addition to SHA256SUMS
+func vaultSnapshot(t *testing.T, meta string, state []byte, extra ...archiveFile) []byte {
+	t.Helper()
+	sums := fmt.Sprintf("%x  %s\n%x  %s\n", sha256.Sum256([]byte(meta)), snapshotMetaFile, sha256.Sum256(state), snapshotStateFile)
+	files := []archiveFile{
+		{snapshotMetaFile, []byte(meta)},
+		{snapshotStateFile, state},
+		{snapshotSumsFile, []byte(sums)},
+		{snapshotSealedSumsFile, []byte("\x00sealed-by-barrier\xff")},
+	}
+	files = append(files, extra...)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := archive.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write(f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const testSnapshotMeta = `{"Version":1,"ID":"2-42-1","Index":42,"Term":2}`
+
+func TestVerifySnapshot(t *testing.T) {
+	state := bytes.Repeat([]byte("raft state"), 1000)
+	meta, err := VerifySnapshot(bytes.NewReader(vaultSnapshot(t, testSnapshotMeta, state)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if meta.Index != 42 || meta.Term != 2 {
+		t.Errorf("got index %d, term %d, want 42, 2", meta.Index, meta.Term)
+	}
+}
+
+func TestVerifySnapshotErrors(t *testing.T) {
+	state := []byte("raft state")
+	valid := vaultSnapshot(t, testSnapshotMeta, state)
+
+	corrupt := vaultSnapshot(t, testSnapshotMeta, state)
+	// flip a byte inside the compressed data
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	tests := []struct {
+		name     string
+		snapshot []byte
+		want     string
+	}{
+		{"not gzip", []byte("not a snapshot"), "not a gzip archive"},
+		{"truncated", valid[:len(valid)-10], ""},
+		{"corrupt", corrupt, ""},
+		{"unexpected file", vaultSnapshot(t, testSnapshotMeta, state, archiveFile{"extra", nil}), "unexpected file extra"},
+		{"invalid meta", vaultSnapshot(t, `{"Version":1,"Index":0,"Term":0}`, state), "invalid snapshot metadata"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := VerifySnapshot(bytes.NewReader(test.snapshot))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %q, want it to contain %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package snapshot_agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+)
+
+// Event types sent to webhooks
+const (
+	EventSnapshotSucceeded       = "snapshot_succeeded"
+	EventSnapshotFailed          = "snapshot_failed"
+	EventSnapshotPartiallyFailed = "snapshot_partially_failed"
+	EventRetentionDeleted        = "retention_deleted"
+	EventSnapshotStale           = "snapshot_stale"
+)
+
+var eventTypes = []string{
+	EventSnapshotSucceeded,
+	EventSnapshotFailed,
+	EventSnapshotPartiallyFailed,
+	EventRetentionDeleted,
+	EventSnapshotStale,
+}
+
+const webhookTimeout = 10 * time.Second
+
+// Event is the JSON document posted to generic webhooks
+type Event struct {
+	Type         string             `json:"event"`
+	Time         time.Time          `json:"time"`
+	Host         string             `json:"host,omitempty"`
+	RunID        string             `json:"run_id,omitempty"`
+	Index        uint64             `json:"index,omitempty"`
+	Term         uint64             `json:"term,omitempty"`
+	Size         int64              `json:"size,omitempty"`
+	Destinations []EventDestination `json:"destinations,omitempty"`
+	Error        string             `json:"error,omitempty"`
+}
+
+// EventDestination is the outcome of an event for a single destination
+type EventDestination struct {
+	Destination string   `json:"destination"`
+	Name        string   `json:"name,omitempty"`
+	Location    string   `json:"location,omitempty"`
+	Deleted     []string `json:"deleted,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// NewEvent creates an event of the given type for the snapshot run of ctx
+func NewEvent(ctx context.Context, eventType string) *Event {
+	host, _ := os.Hostname()
+	return &Event{Type: eventType, Time: time.Now().UTC(), Host: host, RunID: RunID(ctx)}
+}
+
+// Summary is a one line description of the event for chat messages
+func (e *Event) Summary() string {
+	var names []string
+	for _, dest := range e.Destinations {
+		names = append(names, dest.Destination)
+	}
+	switch e.Type {
+	case EventSnapshotSucceeded:
+		return fmt.Sprintf("Vault snapshot at index %d written to %s", e.Index, strings.Join(names, ", "))
+	case EventSnapshotFailed:
+		return "Vault snapshot failed: " + e.failures()
+	case EventSnapshotPartiallyFailed:
+		return "Vault snapshot failed on some storages: " + e.failures()
+	case EventRetentionDeleted:
+		deleted := 0
+		for _, dest := range e.Destinations {
+			deleted += len(dest.Deleted)
+		}
+		return fmt.Sprintf("Retention policy deleted %d snapshots from %s", deleted, strings.Join(names, ", "))
+	case EventSnapshotStale:
+		return "No recent Vault snapshot on " + strings.Join(names, ", ")
+	}
+	return e.Type
+}
+
+func (e *Event) failures() string {
+	var failures []string
+	if e.Error != "" {
+		failures = append(failures, e.Error)
+	}
+	for _, dest := range e.Destinations {
+		if dest.Error != "" {
+			failures = append(failures, dest.Destination+": "+dest.Error)
+		}
+	}
+	return strings.Join(failures, "; ")
+}
+
+// Notifier posts events to the configured webhooks
+type Notifier struct {
+	webhooks []*webhook
+	client   *http.Client
+	retry    *RetryPolicy
+}
+
+type webhook struct {
+	url      string
+	headers  map[string]string
+	events   map[string]bool
+	template *template.Template
+}
+
+// payload templates of the supported formats, rendered with an Event
+var webhookFormats = map[string]string{
+	"generic": `{{json .}}`,
+	"slack":   `{"text": {{json .Summary}}}`,
+	"teams": `{"@type": "MessageCard", "@context": "http://schema.org/extensions",
+"themeColor": {{if eq .Type "snapshot_succeeded" "retention_deleted"}}"2eb886"{{else}}"d9534f"{{end}},
+"summary": {{json .Summary}}, "title": "Vault raft snapshot agent",
+"text": {{json .Summary}}, "sections": [{"facts": [
+{"name": "Host", "value": {{json .Host}}},
+{"name": "Run", "value": {{json .RunID}}}]}]}`,
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// NewNotifier creates a notifier for the configured webhooks
+func NewNotifier(config *config.Configuration, retry *RetryPolicy) (*Notifier, error) {
+	n := &Notifier{client: &http.Client{Timeout: webhookTimeout}, retry: retry}
+	for i, hook := range config.Webhooks {
+		if hook.URL == "" {
+			return nil, fmt.Errorf("webhook %d has no url", i)
+		}
+		format := hook.Template
+		if format == "" {
+			name := hook.Format
+			if name == "" {
+				name = "generic"
+			}
+			var ok bool
+			if format, ok = webhookFormats[name]; !ok {
+				return nil, fmt.Errorf("unknown webhook format %q, must be generic, slack or teams", hook.Format)
+			}
+		}
+		tmpl, err := template.New(hook.URL).Funcs(webhookFuncs).Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %v", err)
+		}
+		events := make(map[string]bool)
+		for _, event := range hook.Events {
+			if !isEventType(event) {
+				return nil, fmt.Errorf("unknown webhook event %q", event)
+			}
+			events[event] = true
+		}
+		if len(events) == 0 {
+			for _, event := range eventTypes {
+				events[event] = true
+			}
+		}
+		n.webhooks = append(n.webhooks, &webhook{url: hook.URL, headers: hook.Headers, events: events, template: tmpl})
+	}
+	return n, nil
+}
+
+func isEventType(event string) bool {
+	for _, eventType := range eventTypes {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify posts the event to every webhook subscribed to it.  Failures are
+// retried and logged, but never fail the snapshot.
+func (n *Notifier) Notify(ctx context.Context, event *Event) {
+	var wg sync.WaitGroup
+	for _, hook := range n.webhooks {
+		if !hook.events[event.Type] {
+			continue
+		}
+		wg.Add(1)
+		go func(hook *webhook) {
+			defer wg.Done()
+			err := n.retry.Do(ctx, "notify webhook", func() error {
+				return n.post(ctx, hook, event)
+			})
+			if err != nil {
+				Logger(ctx).Error("Unable to notify webhook", "url", hook.url, "event", event.Type, "error", err)
+			}
+		}(hook)
+	}
+	wg.Wait()
+}
+
+func (n *Notifier) post(ctx context.Context, hook *webhook, event *Event) error {
+	var body bytes.Buffer
+	if err := hook.template.Execute(&body, event); err != nil {
+		return Permanent(err)
+	}
+	req, err := http.NewRequest("POST", hook.url, &body)
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range hook.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("webhook returned %s", resp.Status)
+		// client errors other than rate limiting will not go away by retrying
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// NotifyRun sends the outcome of a snapshot run, and the snapshots deleted by
+// the retention policy, to the webhooks.  err is the error of TakeSnapshot or
+// of the steps before it.
+func (s *Snapshotter) NotifyRun(ctx context.Context, run *SnapshotRun, err error) {
+	event := NewEvent(ctx, EventSnapshotSucceeded)
+	if err != nil {
+		event.Type = EventSnapshotFailed
+		event.Error = err.Error()
+	}
+	if run == nil {
+		s.Notifier.Notify(ctx, event)
+		return
+	}
+	if run.Meta != nil {
+		event.Index = run.Meta.Index
+		event.Term = run.Meta.Term
+	}
+	event.Size = run.Size
+	failed := 0
+	retention := NewEvent(ctx, EventRetentionDeleted)
+	for _, result := range run.Results {
+		dest := EventDestination{Destination: result.Destination, Name: result.Name, Location: result.Location}
+		if result.Err != nil {
+			failed++
+			dest.Error = result.Err.Error()
+		}
+		event.Destinations = append(event.Destinations, dest)
+		if len(result.Deleted) > 0 {
+			retention.Destinations = append(retention.Destinations, EventDestination{
+				Destination: result.Destination,
+				Deleted:     snapshotNames(result.Deleted),
+			})
+		}
+	}
+	switch {
+	case err != nil:
+	case failed == len(run.Results) && failed > 0:
+		event.Type = EventSnapshotFailed
+	case failed > 0:
+		event.Type = EventSnapshotPartiallyFailed
+	}
+	s.Notifier.Notify(ctx, event)
+	if len(retention.Destinations) > 0 {
+		s.Notifier.Notify(ctx, retention)
+	}
+}
+
+// NotifyPrune sends the snapshots deleted by Prune to the webhooks
+func (s *Snapshotter) NotifyPrune(ctx context.Context, results []PruneResult) {
+	event := NewEvent(ctx, EventRetentionDeleted)
+	for _, result := range results {
+		if len(result.Deleted) > 0 {
+			event.Destinations = append(event.Destinations, EventDestination{
+				Destination: result.Destination,
+				Deleted:     snapshotNames(result.Deleted),
+			})
+		}
+	}
+	if len(event.Destinations) > 0 {
+		s.Notifier.Notify(ctx, event)
+	}
+}
+
+// NotifyStale sends the destinations that have not received a snapshot within
+// the staleness threshold to the webhooks
+func (s *Snapshotter) NotifyStale(ctx context.Context, stale []EventDestination) {
+	event := NewEvent(ctx, EventSnapshotStale)
+	event.Destinations = stale
+	s.Notifier.Notify(ctx, event)
+}
+
+func snapshotNames(snapshots []SnapshotInfo) []string {
+	names := make([]string, len(snapshots))
+	for i, snapshot := range snapshots {
+		names[i] = snapshot.Name
+	}
+	return names
+}
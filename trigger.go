@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Lucretius/vault_raft_snapshot_agent/config"
+	"github.com/Lucretius/vault_raft_snapshot_agent/snapshot_agent"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// errShuttingDown is returned for snapshots requested after a shutdown began
+	errShuttingDown = errors.New("agent is shutting down")
+	// errNotLoggedIn is returned for snapshots requested before the agent could log in to Vault
+	errNotLoggedIn = errors.New("agent has not logged in to Vault yet")
+)
+
+// agent runs snapshots of the daemon, whether scheduled or triggered out of
+// band, one at a time
+type agent struct {
+	config *config.Configuration
+	done   chan struct{}
+	health *health
+	mu     sync.Mutex
+}
+
+func newAgent(c *config.Configuration, done chan struct{}) (*agent, error) {
+	h, err := newHealth(c)
+	if err != nil {
+		return nil, err
+	}
+	return &agent{config: c, done: done, health: h}, nil
+}
+
+// snapshot takes a snapshot once no other snapshot is running
+func (a *agent) snapshot(ctx context.Context) (*snapshot_agent.SnapshotRun, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if shuttingDown(a.done) {
+		return nil, errShuttingDown
+	}
+	snapshotter := a.health.getSnapshotter()
+	if snapshotter == nil {
+		return nil, errNotLoggedIn
+	}
+	a.health.running(true)
+	defer a.health.running(false)
+	ctx, _ = snapshot_agent.WithRunID(ctx)
+	run, err := takeSnapshot(ctx, snapshotter, a.config)
+	a.health.record(run, err)
+	return run, err
+}
+
+// waitUntil waits for the next scheduled snapshot and returns false if the agent
+// is shutting down
+func (a *agent) waitUntil(next time.Time) bool {
+	a.health.scheduled(next)
+	return waitUntil(next, a.done)
+}
+
+// wait blocks until the running snapshot, if any, has finished
+func (a *agent) wait() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+}
+
+// listenForTriggerSignal takes a snapshot whenever the agent receives SIGUSR1
+func (a *agent) listenForTriggerSignal(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			snapshot_agent.Logger(ctx).Info("Received SIGUSR1, taking snapshot")
+			if _, err := a.snapshot(ctx); err == errShuttingDown || err == errNotLoggedIn {
+				snapshot_agent.Logger(ctx).Warn("Not taking snapshot", "error", err)
+			}
+		}
+	}()
+}
+
+// snapshotResponse is the JSON body returned by POST /v1/snapshot
+type snapshotResponse struct {
+	Index   uint64           `json:"index,omitempty"`
+	Term    uint64           `json:"term,omitempty"`
+	Results []snapshotResult `json:"results"`
+	Error   string           `json:"error,omitempty"`
+}
+
+type snapshotResult struct {
+	Destination string `json:"destination"`
+	Name        string `json:"name,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// handleSnapshot takes a snapshot and reports its outcome per destination.  The
+// snapshot runs to completion even if the client disconnects.
+func (a *agent) handleSnapshot(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !a.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		snapshot_agent.Logger(ctx).Info("Snapshot requested over HTTP", "remote_addr", r.RemoteAddr)
+		run, err := a.snapshot(ctx)
+
+		response := snapshotResponse{Results: make([]snapshotResult, 0)}
+		status := http.StatusOK
+		switch exitCode(run, err) {
+		case exitOK:
+		case exitNotLeader:
+			status = http.StatusConflict
+		default:
+			status = http.StatusInternalServerError
+		}
+		if err == errShuttingDown || err == errNotLoggedIn {
+			status = http.StatusServiceUnavailable
+		}
+		if err != nil {
+			response.Error = err.Error()
+		} else {
+			if run.Meta != nil {
+				response.Index = run.Meta.Index
+				response.Term = run.Meta.Term
+			}
+			for _, result := range run.Results {
+				res := snapshotResult{Destination: result.Destination, Name: result.Name, Location: result.Location}
+				if result.Err != nil {
+					res.Error = result.Err.Error()
+				}
+				response.Results = append(response.Results, res)
+			}
+		}
+		writeJSON(w, status, response)
+	}
+}
+
+// authorized checks the bearer token of a request against the configured token
+func (a *agent) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if a.config.HTTP.Token == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.config.HTTP.Token)) == 1
+}
+
+// serveHTTP starts the HTTP API if a listen address is configured, and stops
+// it when the agent shuts down
+func (a *agent) serveHTTP(ctx context.Context) error {
+	if a.config.HTTP.ListenAddress == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", a.health.handleHealthz)
+	mux.HandleFunc("/readyz", a.health.handleReadyz)
+	mux.HandleFunc("/status", a.health.handleStatus)
+	// triggering snapshots requires a token
+	if a.config.HTTP.Token != "" {
+		mux.Handle("/v1/snapshot", a.handleSnapshot(ctx))
+	}
+	server := &http.Server{Addr: a.config.HTTP.ListenAddress, Handler: mux}
+
+	listener, err := net.Listen("tcp", a.config.HTTP.ListenAddress)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-a.done
+		// the running snapshot is awaited by the agent itself
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		snapshot_agent.Logger(ctx).Info("Serving HTTP API", "address", listener.Addr().String())
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			snapshot_agent.Logger(ctx).Error("HTTP API stopped", "error", err)
+		}
+	}()
+	return nil
+}